@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// sendmailArgs are the traditional single dash sendmail options
+type sendmailArgs struct {
+	extractRecipients bool     // -t
+	ignoreDots        bool     // -i, -oi
+	sender            string   // -f, -r
+	fullName          string   // -F
+	smtpStdio         bool     // -bs
+	config            string   // -C
+	recipients        []string // remaining arguments
+}
+
+// sendmail options that take a value and are accepted but ignored
+const ignoredWithValue = "BLNOpRVX"
+
+// sendmail options that may be combined with the options following them, as
+// in -ti or -tf sender
+const combinable = "tiv"
+
+// parseArgs splits args into the sendmail options and recipients, and the
+// double dash options that are parsed by flags
+func parseArgs(flags *pflag.FlagSet, args []string) (*sendmailArgs, []string, error) {
+	sa := &sendmailArgs{recipients: make([]string, 0)}
+	long := make([]string, 0)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// split a combined option into its first option and the rest
+		if len(arg) > 2 && arg[0] == '-' && arg[2] != '-' && strings.ContainsRune(combinable, rune(arg[1])) {
+			args = slices.Concat(args[:i], []string{arg[:2], "-" + arg[2:]}, args[i+1:])
+			arg = args[i]
+		}
+
+		// value of an option given either attached or as the next argument
+		value := func(attached string) (string, error) {
+			if attached != "" {
+				return attached, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires an argument", arg)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch {
+		case arg == "--":
+			sa.recipients = append(sa.recipients, args[i+1:]...)
+			return sa, long, nil
+		case strings.HasPrefix(arg, "--"):
+			long = append(long, arg)
+			// pass the value of a non-boolean option along with it
+			name, _, hasValue := strings.Cut(arg[2:], "=")
+			if f := flags.Lookup(name); f != nil && !hasValue && f.NoOptDefVal == "" && i+1 < len(args) {
+				i++
+				long = append(long, args[i])
+			}
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			sa.recipients = append(sa.recipients, arg)
+		case arg == "-t":
+			sa.extractRecipients = true
+		case arg == "-i" || arg == "-oi":
+			sa.ignoreDots = true
+		case arg == "-bs":
+			sa.smtpStdio = true
+		case arg == "-bm" || arg == "-v":
+			// deliver mail (the default) and verbose are no-ops
+		case strings.HasPrefix(arg, "-b"):
+			return nil, nil, fmt.Errorf("unsupported mode %s", arg)
+		case strings.HasPrefix(arg, "-f"), strings.HasPrefix(arg, "-r"):
+			v, err := value(arg[2:])
+			if err != nil {
+				return nil, nil, err
+			}
+			sa.sender = v
+		case strings.HasPrefix(arg, "-F"):
+			v, err := value(arg[2:])
+			if err != nil {
+				return nil, nil, err
+			}
+			sa.fullName = v
+		case strings.HasPrefix(arg, "-C"):
+			v, err := value(arg[2:])
+			if err != nil {
+				return nil, nil, err
+			}
+			sa.config = v
+		case strings.HasPrefix(arg, "-o"):
+			// other -oX options such as -odi and -oem are ignored
+		case strings.ContainsRune(ignoredWithValue, rune(arg[1])):
+			if _, err := value(arg[2:]); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	return sa, long, nil
+}
+
+// check reports whether the options are usable, as without -t the recipients
+// must be given as arguments
+func (sa *sendmailArgs) check() error {
+	if !sa.smtpStdio && !sa.extractRecipients && len(sa.recipients) == 0 {
+		return fmt.Errorf("no recipients given and -t not set")
+	}
+
+	return nil
+}
+
+// readMessage reads a message from r. Unless ignoreDots is set, a line
+// containing only a dot ends the message as with traditional sendmail.
+func readMessage(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return io.ReadAll(r)
+	}
+
+	var buf bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(".")) {
+			return buf.Bytes(), nil
+		}
+		buf.Write(line)
+
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
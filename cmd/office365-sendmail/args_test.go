@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestParseArgs(t *testing.T) {
+	flags := pflag.NewFlagSet("sendmail", pflag.ContinueOnError)
+	flags.String("senduser", "", "")
+	flags.Bool("debug", false, "")
+
+	tests := []struct {
+		name     string
+		args     []string
+		want     *sendmailArgs
+		wantLong []string
+		wantErr  bool
+	}{
+		{
+			name: "recipients",
+			args: []string{"alice@example.com", "bob@example.com"},
+			want: &sendmailArgs{recipients: []string{"alice@example.com", "bob@example.com"}},
+		},
+		{
+			name: "separate options",
+			args: []string{"-t", "-i", "-f", "sender@example.com", "-F", "Full Name"},
+			want: &sendmailArgs{extractRecipients: true, ignoreDots: true, sender: "sender@example.com", fullName: "Full Name", recipients: []string{}},
+		},
+		{
+			name: "attached values",
+			args: []string{"-rsender@example.com", "-C/etc/sendmail.yaml", "alice@example.com"},
+			want: &sendmailArgs{sender: "sender@example.com", config: "/etc/sendmail.yaml", recipients: []string{"alice@example.com"}},
+		},
+		{
+			name: "combined options",
+			args: []string{"-ti"},
+			want: &sendmailArgs{extractRecipients: true, ignoreDots: true, recipients: []string{}},
+		},
+		{
+			name: "combined options in either order",
+			args: []string{"-itv", "alice@example.com"},
+			want: &sendmailArgs{extractRecipients: true, ignoreDots: true, recipients: []string{"alice@example.com"}},
+		},
+		{
+			name: "combined option with value",
+			args: []string{"-tf", "sender@example.com"},
+			want: &sendmailArgs{extractRecipients: true, sender: "sender@example.com", recipients: []string{}},
+		},
+		{
+			name: "ignored options",
+			args: []string{"-oi", "-odi", "-oem", "-bm", "-v", "-B", "8BITMIME", "alice@example.com"},
+			want: &sendmailArgs{ignoreDots: true, recipients: []string{"alice@example.com"}},
+		},
+		{
+			name: "smtp on stdio",
+			args: []string{"-bs"},
+			want: &sendmailArgs{smtpStdio: true, recipients: []string{}},
+		},
+		{
+			name:     "long options",
+			args:     []string{"--senduser", "relay@example.com", "--debug", "alice@example.com"},
+			want:     &sendmailArgs{recipients: []string{"alice@example.com"}},
+			wantLong: []string{"--senduser", "relay@example.com", "--debug"},
+		},
+		{
+			name: "end of options",
+			args: []string{"-t", "--", "-alice@example.com"},
+			want: &sendmailArgs{extractRecipients: true, recipients: []string{"-alice@example.com"}},
+		},
+		{name: "missing value", args: []string{"-f"}, wantErr: true},
+		{name: "combined option missing value", args: []string{"-tf"}, wantErr: true},
+		{name: "unsupported mode", args: []string{"-bp"}, wantErr: true},
+		{name: "unknown option", args: []string{"-x"}, wantErr: true},
+		{name: "unknown combined option", args: []string{"-tx"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, long, err := parseArgs(flags, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseArgs(%q) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseArgs(%q) = %+v, want %+v", tt.args, got, tt.want)
+			}
+			if tt.wantLong == nil {
+				tt.wantLong = []string{}
+			}
+			if !reflect.DeepEqual(long, tt.wantLong) {
+				t.Errorf("parseArgs(%q) long options = %q, want %q", tt.args, long, tt.wantLong)
+			}
+		})
+	}
+}
+
+func TestSendmailArgsCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    sendmailArgs
+		wantErr bool
+	}{
+		{"recipients", sendmailArgs{recipients: []string{"alice@example.com"}}, false},
+		{"extract recipients", sendmailArgs{extractRecipients: true}, false},
+		{"smtp on stdio", sendmailArgs{smtpStdio: true}, false},
+		{"no recipients", sendmailArgs{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.args.check(); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		ignoreDots bool
+		want       string
+	}{
+		{"until eof", "Subject: test\r\n\r\nbody\r\n", false, "Subject: test\r\n\r\nbody\r\n"},
+		{"no final newline", "Subject: test\r\n\r\nbody", false, "Subject: test\r\n\r\nbody"},
+		{"dot ends message", "Subject: test\r\n\r\nbody\r\n.\r\nignored\r\n", false, "Subject: test\r\n\r\nbody\r\n"},
+		{"dot with lf", "Subject: test\n\nbody\n.\nignored\n", false, "Subject: test\n\nbody\n"},
+		{"dot within line", "Subject: test\r\n\r\n.body\r\nend.\r\n", false, "Subject: test\r\n\r\n.body\r\nend.\r\n"},
+		{"ignore dots", "Subject: test\r\n\r\nbody\r\n.\r\nmore\r\n", true, "Subject: test\r\n\r\nbody\r\n.\r\nmore\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMessage(strings.NewReader(tt.input), tt.ignoreDots)
+			if err != nil {
+				t.Fatalf("readMessage() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("readMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
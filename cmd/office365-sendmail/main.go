@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/mail"
 	"os"
+	"slices"
+	"strings"
 
-	"github.com/OfimaticSRL/parsemail"
+	"github.com/emersion/go-smtp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
-	"github.com/tombull/office365-smtp-proxy/pkg/sendmail"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
 )
 
 func main() {
@@ -23,48 +30,63 @@ func main() {
 	pflag.String("clientid", "", "App Registration Client/Application ID")
 	pflag.String("tenantid", "", "App Registration Tenant ID")
 	pflag.String("secret", "", "App Registration Client Secret")
-	pflag.Parse()
 
 	// sending options
-	pflag.Bool("sentitems", false, "Save to sent items in senders mailbox")
+	pflag.String("senduser", "", "Graph user ID to send as instead of the From address")
+	pflag.String("envelope", graphserver.EnvelopeOverride, "How recipients are applied to MIME headers (override or preserve)")
+	pflag.String("domain", "localhost", "Hostname used in the SMTP greeting for -bs")
+	pflag.Bool("sentitems", true, "Save to sent items in senders mailbox")
+	pflag.CommandLine.MarkDeprecated("sentitems", "messages are always saved to sent items")
+
+	// split traditional sendmail options from the double dash options
+	args, long, err := parseArgs(pflag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(exitUsage)
+	}
+	if err := pflag.CommandLine.Parse(long); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if err := args.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(exitUsage)
+	}
+	if args.config != "" {
+		pflag.Set("config", args.config)
+	}
 
 	// viper setup
 	viper.SetEnvPrefix("sendmail")
 	viper.AutomaticEnv()
 	viper.BindPFlags(pflag.CommandLine)
 
-	// set up logger
-	logLevel := new(slog.LevelVar)
+	// set up logger, keeping stdout clear when it carries SMTP
+	var out io.Writer = os.Stdout
+	if args.smtpStdio {
+		out = os.Stderr
+	}
 	if viper.GetBool("quiet") {
 		// discard all log messages in quiet mode
-		h := slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
-			Level: logLevel,
-			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-				// discard time
-				if a.Key == slog.TimeKey {
-					return slog.Attr{}
-				}
-
-				return a
-			},
-		})
-		slog.SetDefault(slog.New(h))
-	} else {
-		// otherwise send to stdout
-		h := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: logLevel,
-			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-				// discard time
-				if a.Key == slog.TimeKey {
-					return slog.Attr{}
-				}
-
-				return a
-			},
-		})
-		slog.SetDefault(slog.New(h))
+		out = io.Discard
 	}
 
+	logLevel := new(slog.LevelVar)
+	h := slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// discard time
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(h))
+
 	if viper.GetBool("debug") {
 		logLevel.Set(slog.LevelDebug)
 	}
@@ -84,82 +106,247 @@ func main() {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			if config != "" {
 				slog.Error("config file not found", "error", err, "config", config)
-				os.Exit(1)
+				os.Exit(exitConfig)
 			} else {
 				slog.Info("running without config")
 			}
 		} else {
 			slog.Error("config file was invalid", "error", err, "config", viper.ConfigFileUsed())
-			os.Exit(1)
+			os.Exit(exitConfig)
 		}
 	} else {
 		slog.Info("config file loaded", "config", viper.ConfigFileUsed())
 	}
 
+	mode := viper.GetString("envelope")
+	if mode != graphserver.EnvelopeOverride && mode != graphserver.EnvelopePreserve {
+		slog.Error("invalid envelope mode", "envelope", mode)
+		os.Exit(exitConfig)
+	}
+
+	cred := graphclient.WithClientSecret(viper.GetString("tenantid"), viper.GetString("clientId"), viper.GetString("secret"))
+
+	if args.smtpStdio {
+		os.Exit(serveStdio(cred, mode))
+	}
+
+	os.Exit(sendStdin(cred, mode, args))
+}
+
+// sendStdin sends the message on stdin, returning the exit code
+func sendStdin(cred graphclient.ClientOption, mode string, args *sendmailArgs) int {
 	// create graph client
-	client, err := graphclient.NewClient(viper.GetString("tenantid"), viper.GetString("clientId"), viper.GetString("secret"))
+	client, err := graphclient.NewClient(cred)
 	if err != nil {
 		slog.Error("could not create graph client", "error", err)
-		os.Exit(1)
+		return exitConfig
 	}
 
-	// parse incoming message
-	msg, err := parsemail.Parse(os.Stdin)
+	// read incoming message
+	raw, err := readMessage(os.Stdin, args.ignoreDots)
 	if err != nil {
 		slog.Error("unable to read message", "error", err)
-		os.Exit(1)
+		return exitIOErr
 	}
 
-	// with debug enabled show whole message
-	slog.Debug("message", "msg", msg)
-
-	// grab headers and content
-	header := msg.Header
-	subject := header.Get("Subject")
-	from := header.Get("From")
-	to := header.Get("To")
-
-	// message options
-	opts := []sendmail.MessageOption{
-		sendmail.WithAttachments(msg.Attachments),
-		sendmail.WithSaveToSentItems(viper.GetBool("sentitems")),
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		slog.Error("unable to read message", "error", err)
+		return exitDataErr
 	}
 
-	// add context to logger
-	logger := slog.With("from", from, "to", to, "subject", subject)
+	// the envelope sender is -f, otherwise the From header
+	from := args.sender
+	if from == "" {
+		from, err = headerSender(msg.Header)
+		if err != nil {
+			if from = viper.GetString("senduser"); from == "" {
+				slog.Error("invalid sender", "error", err)
+				return exitDataErr
+			}
+		}
+	}
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = strings.ToLower(addr.Address)
+	} else {
+		slog.Error("invalid sender", "error", err, "from", from)
+		return exitDataErr
+	}
 
-	// add Cc recipients
-	if cc := header.Get("Cc"); cc != "" {
-		logger = logger.With("cc", cc)
-		opts = append(opts, sendmail.WithCc(cc))
+	// the full name is only used when the message has no From header
+	if msg.Header.Get("From") == "" {
+		header := "From: " + (&mail.Address{Name: args.fullName, Address: from}).String() + "\r\n"
+		raw = append([]byte(header), raw...)
 	}
 
-	// add Bcc recipients
-	if bcc := header.Get("Bcc"); bcc != "" {
-		logger = logger.With("bcc", bcc)
-		opts = append(opts, sendmail.WithBcc(bcc))
+	// recipients are taken from the arguments and with -t the headers
+	recipients, err := normalizeRecipients(args.recipients)
+	if err != nil {
+		slog.Error("invalid recipients", "error", err)
+		return exitDataErr
+	}
+	if args.extractRecipients {
+		fromHeaders, err := headerRecipients(msg.Header)
+		if err != nil && len(recipients) == 0 {
+			slog.Error("invalid recipients", "error", err)
+			return exitDataErr
+		}
+		for _, rcpt := range fromHeaders {
+			if !slices.Contains(recipients, rcpt) {
+				recipients = append(recipients, rcpt)
+			}
+		}
 	}
 
-	// handle HTML or text bodies
-	if msg.TextBody == "" {
-		logger = logger.With("size", len(msg.HTMLBody), "type", "text/html")
-		opts = append(opts, sendmail.WithBody(msg.HTMLBody), sendmail.WithHTMLContent())
-	} else if msg.HTMLBody == "" {
-		logger = logger.With("size", len(msg.TextBody), "type", "text/plain")
-		opts = append(opts, sendmail.WithBody(msg.TextBody))
+	graphUser := from
+	if sendUser := viper.GetString("senduser"); sendUser != "" {
+		graphUser = sendUser
 	}
 
-	// create the request ready to POST
-	message := sendmail.NewMessage(from, to, subject, opts...)
+	// add context to logger
+	logger := slog.With("from", from, "graph_user", graphUser, "to", strings.Join(recipients, ","), "subject", msg.Header.Get("Subject"), "size", len(raw))
 
-	// create user object
-	user := client.Users().ByUserId(from)
+	// apply the same validation and envelope handling as the SMTP server
+	payload, err := prepareMessage(raw, msg.Header, from, recipients, mode)
+	if err != nil {
+		logger.Error("rejected MIME message", "error", err)
+		return exitDataErr
+	}
+
+	// with debug enabled show whole message
+	logger.Debug("message", "mime", string(payload))
 
 	// send email
-	if err := message.Send(context.Background(), user); err != nil {
+	if err := client.SendMime(context.Background(), graphUser, from, recipients, payload); err != nil {
 		logger.Error("error sending email", "error", err)
-		os.Exit(1)
+		return sendExitCode(err)
 	}
 
 	logger.Info("message sent")
+
+	return exitOK
+}
+
+// serveStdio speaks SMTP over stdin and stdout for sendmail -bs, returning
+// the exit code
+func serveStdio(cred graphclient.ClientOption, mode string) int {
+	be, err := graphserver.NewGraphBackend(cred,
+		graphserver.WithSendUser(viper.GetString("senduser")),
+		graphserver.WithEnvelopeMode(mode),
+		graphserver.WithDomain(viper.GetString("domain")),
+		graphserver.WithLogger(slog.Default()),
+	)
+	if err != nil {
+		slog.Error("error setting up backend", "error", err)
+		return exitConfig
+	}
+
+	s := smtp.NewServer(be)
+	s.Domain = viper.GetString("domain")
+	s.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelError)
+
+	if err := s.Serve(newStdioListener(os.Stdin, os.Stdout)); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("smtp session failed", "error", err)
+		return exitIOErr
+	}
+
+	return exitOK
+}
+
+// headerSender returns the address in the From header
+func headerSender(header mail.Header) (string, error) {
+	addresses, err := header.AddressList("From")
+	if err != nil {
+		return "", fmt.Errorf("invalid From header: %w", err)
+	}
+
+	if len(addresses) != 1 {
+		return "", fmt.Errorf("From header must contain a single address")
+	}
+
+	return strings.ToLower(addresses[0].Address), nil
+}
+
+// headerRecipients returns the unique addresses in the To, Cc and Bcc headers
+func headerRecipients(header mail.Header) ([]string, error) {
+	recipients, err := headerAddresses(header, "To", "Cc", "Bcc")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("message has no recipients")
+	}
+
+	return recipients, nil
+}
+
+// headerAddresses returns the unique addresses in the given headers, which may
+// be missing
+func headerAddresses(header mail.Header, keys ...string) ([]string, error) {
+	recipients := make([]string, 0)
+	for _, key := range keys {
+		addresses, err := header.AddressList(key)
+		if err != nil {
+			if errors.Is(err, mail.ErrHeaderNotPresent) {
+				continue
+			}
+			return nil, fmt.Errorf("invalid %s header: %w", key, err)
+		}
+
+		for _, address := range addresses {
+			if addr := strings.ToLower(address.Address); !slices.Contains(recipients, addr) {
+				recipients = append(recipients, addr)
+			}
+		}
+	}
+
+	return recipients, nil
+}
+
+// prepareMessage applies the envelope to the headers of raw as the SMTP server
+// does. Recipients listed only in the Bcc header, such as those added by -t,
+// are delivered but left out of the rewritten To header so they are not
+// disclosed.
+func prepareMessage(raw []byte, header mail.Header, from string, recipients []string, mode string) ([]byte, error) {
+	bcc, _ := headerAddresses(header, "Bcc")
+	visible, _ := headerAddresses(header, "To", "Cc")
+
+	shown := make([]string, 0, len(recipients))
+	for _, rcpt := range recipients {
+		if !slices.Contains(bcc, rcpt) || slices.Contains(visible, rcpt) {
+			shown = append(shown, rcpt)
+		}
+	}
+
+	// with only Bcc recipients there is nothing to write to To
+	if len(shown) == 0 {
+		mode = graphserver.EnvelopePreserve
+	}
+
+	return graphserver.PrepareGraphMIME(raw, graphserver.Envelope{
+		From:       from,
+		Recipients: shown,
+		Mode:       mode,
+	})
+}
+
+// normalizeRecipients parses recipient arguments, which may each contain a
+// comma separated list of addresses
+func normalizeRecipients(args []string) ([]string, error) {
+	recipients := make([]string, 0, len(args))
+	for _, arg := range args {
+		addresses, err := mail.ParseAddressList(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", arg, err)
+		}
+
+		for _, address := range addresses {
+			if addr := strings.ToLower(address.Address); !slices.Contains(recipients, addr) {
+				recipients = append(recipients, addr)
+			}
+		}
+	}
+
+	return recipients, nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+)
+
+func readHeader(t *testing.T, header string) mail.Header {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(header + "\r\n"))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	return msg.Header
+}
+
+func TestHeaderSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"address", "From: Printer@Example.com\r\n", "printer@example.com", false},
+		{"display name", "From: \"Office Printer\" <Printer@Example.com>\r\n", "printer@example.com", false},
+		{"missing", "Subject: test\r\n", "", true},
+		{"several addresses", "From: a@example.com, b@example.com\r\n", "", true},
+		{"invalid", "From: not an address\r\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := headerSender(readHeader(t, tt.header))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("headerSender() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("headerSender() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderRecipients(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    []string
+		wantErr bool
+	}{
+		{"to", "To: Alice@Example.com\r\n", []string{"alice@example.com"}, false},
+		{"to cc and bcc", "To: alice@example.com\r\nCc: \"Bob\" <bob@example.com>\r\nBcc: carol@example.com\r\n", []string{"alice@example.com", "bob@example.com", "carol@example.com"}, false},
+		{"duplicates", "To: alice@example.com, bob@example.com\r\nCc: ALICE@example.com\r\n", []string{"alice@example.com", "bob@example.com"}, false},
+		{"bcc only", "Bcc: carol@example.com\r\n", []string{"carol@example.com"}, false},
+		{"no recipients", "Subject: test\r\n", nil, true},
+		{"invalid", "To: alice@example.com\r\nCc: not an address\r\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := headerRecipients(readHeader(t, tt.header))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("headerRecipients() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("headerRecipients() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageHidesBcc(t *testing.T) {
+	raw := "From: printer@example.com\r\nTo: alice@example.com\r\nCc: bob@example.com\r\nBcc: carol@example.com, dave@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+	tests := []struct {
+		name       string
+		raw        string
+		recipients []string
+		mode       string
+		wantTo     string
+	}{
+		{"override", raw, []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com"}, graphserver.EnvelopeOverride, "alice@example.com"},
+		{"override with argument", raw, []string{"erin@example.com", "alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com"}, graphserver.EnvelopeOverride, "erin@example.com"},
+		{"preserve", raw, []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com"}, graphserver.EnvelopePreserve, "alice@example.com"},
+		{"bcc only", "From: printer@example.com\r\nBcc: carol@example.com, dave@example.com\r\nSubject: test\r\n\r\nbody\r\n", []string{"carol@example.com", "dave@example.com"}, graphserver.EnvelopeOverride, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := mail.ReadMessage(strings.NewReader(tt.raw))
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+
+			payload, err := prepareMessage([]byte(tt.raw), msg.Header, "printer@example.com", tt.recipients, tt.mode)
+			if err != nil {
+				t.Fatalf("prepareMessage() error = %v", err)
+			}
+
+			header, _, _ := strings.Cut(string(payload), "\r\n\r\n")
+			for _, bcc := range []string{"carol@example.com", "dave@example.com"} {
+				if strings.Contains(strings.ToLower(header), bcc) {
+					t.Errorf("payload headers disclose %s:\n%s", bcc, header)
+				}
+			}
+			if tt.wantTo != "" && !strings.Contains(header, tt.wantTo) {
+				t.Errorf("payload headers missing %s:\n%s", tt.wantTo, header)
+			}
+		})
+	}
+}
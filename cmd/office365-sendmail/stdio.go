@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// stdioAddr is the address of the stdin/stdout connection
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is a net.Conn reading from stdin and writing to stdout, used to
+// speak SMTP over stdio for sendmail -bs
+type stdioConn struct {
+	io.Reader
+	io.Writer
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *stdioConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// stdioListener accepts a single stdioConn, then returns net.ErrClosed once
+// that connection has been closed so that the server stops.
+type stdioListener struct {
+	conn     *stdioConn
+	accepted bool
+}
+
+func newStdioListener(r io.Reader, w io.Writer) *stdioListener {
+	return &stdioListener{conn: &stdioConn{Reader: r, Writer: w, closed: make(chan struct{})}}
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+
+	<-l.conn.closed
+	return nil, net.ErrClosed
+}
+
+func (l *stdioListener) Close() error   { return l.conn.Close() }
+func (l *stdioListener) Addr() net.Addr { return stdioAddr{} }
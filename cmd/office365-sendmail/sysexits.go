@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+)
+
+// exit codes from sysexits.h, which callers of sendmail rely on to decide
+// whether to retry
+const (
+	exitOK          = 0
+	exitUsage       = 64 // EX_USAGE
+	exitDataErr     = 65 // EX_DATAERR
+	exitNoUser      = 67 // EX_NOUSER
+	exitUnavailable = 69 // EX_UNAVAILABLE
+	exitIOErr       = 74 // EX_IOERR
+	exitTempFail    = 75 // EX_TEMPFAIL
+	exitNoPerm      = 77 // EX_NOPERM
+	exitConfig      = 78 // EX_CONFIG
+)
+
+// sendExitCode maps an error from SendMime to an exit code
+func sendExitCode(err error) int {
+	if errors.Is(err, graphclient.ErrMessageTooLarge) {
+		return exitDataErr
+	}
+
+	if graphclient.IsTransient(err) || errors.Is(err, context.DeadlineExceeded) {
+		return exitTempFail
+	}
+
+	switch code := graphclient.StatusCode(err); {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return exitNoPerm
+	case code == http.StatusNotFound:
+		return exitNoUser
+	case code >= 400 && code < 500:
+		return exitUnavailable
+	default:
+		// network errors and anything unexpected are worth retrying
+		return exitTempFail
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+)
+
+func graphError(status int) error {
+	err := odataerrors.NewODataError()
+	err.SetStatusCode(status)
+	return fmt.Errorf("could not send draft message: %w", err)
+}
+
+func TestSendExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"too large", fmt.Errorf("could not split message: %w", graphclient.ErrMessageTooLarge), exitDataErr},
+		{"throttled", graphError(429), exitTempFail},
+		{"server error", graphError(503), exitTempFail},
+		{"deadline", fmt.Errorf("could not create MIME draft: %w", context.DeadlineExceeded), exitTempFail},
+		{"unauthorized", graphError(401), exitNoPerm},
+		{"forbidden", graphError(403), exitNoPerm},
+		{"unknown user", graphError(404), exitNoUser},
+		{"bad request", graphError(400), exitUnavailable},
+		{"network", errors.New("connection reset by peer"), exitTempFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendExitCode(tt.err); got != tt.want {
+				t.Errorf("sendExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
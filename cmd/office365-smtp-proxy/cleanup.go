@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andrewheberle/redacted-string"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+)
+
+// draftsCleanup removes drafts left behind by failed sends from the given
+// mailboxes
+func draftsCleanup(args []string) {
+	flags := pflag.NewFlagSet("drafts-cleanup", pflag.ExitOnError)
+
+	// general options
+	flags.String("config", "", "Configuration file")
+
+	// cleanup options
+	flags.StringSlice("mailboxes", []string{}, "Mailboxes to remove stale drafts from (defaults to senduser)")
+	flags.String("senduser", "", "Graph user ID to send as for all relayed messages")
+	flags.Duration("older-than", time.Hour, "Only remove drafts older than this")
+
+	// Entra ID options
+	addGraphFlags(flags)
+
+	// parse flags
+	flags.Parse(args)
+
+	// set up logger
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	// load config
+	loadConfig(logger, flags)
+
+	mailboxes := viper.GetStringSlice("mailboxes")
+	if len(mailboxes) == 0 && viper.GetString("senduser") != "" {
+		mailboxes = []string{viper.GetString("senduser")}
+	}
+	if len(mailboxes) == 0 {
+		logger.Error("no mailboxes to clean up, set mailboxes or senduser")
+		os.Exit(1)
+	}
+
+	clients, err := cleanupClients(logger)
+	if err != nil {
+		logger.Error("could not create graph client", "error", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, mailbox := range mailboxes {
+		client := cleanupClientFor(clients, mailbox)
+		if client == nil {
+			logger.Error("no tenant for mailbox", "mailbox", mailbox)
+			failed = true
+			continue
+		}
+
+		deleted, err := client.CleanupDrafts(context.Background(), mailbox, viper.GetDuration("older-than"))
+		if err != nil {
+			logger.Error("could not clean up drafts", "error", err, "mailbox", mailbox, "tenant", client.name, "deleted", deleted)
+			failed = true
+			continue
+		}
+
+		logger.Info("drafts cleaned up", "mailbox", mailbox, "tenant", client.name, "deleted", deleted)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// cleanupClient is a Graph client for the tenant whose mailboxes it cleans up
+type cleanupClient struct {
+	*graphclient.Client
+	name    string
+	domains []string
+}
+
+// cleanupClients returns a client for the default credential, if it is set or
+// there are no tenants, followed by a client for each configured tenant
+func cleanupClients(logger *slog.Logger) ([]cleanupClient, error) {
+	tenants, err := graphTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []cleanupClient
+	if hasDefaultCredential() || len(tenants) == 0 {
+		cred, err := graphCredential()
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := graphclient.NewClient(cred)
+		if err != nil {
+			logger.Error("could not create graph client",
+				"credential", viper.GetString("credential"),
+				"clientid", viper.GetString("clientid"),
+				"tenantid", viper.GetString("tenantid"),
+				"secret", redacted.Redact(viper.GetString("secret")),
+			)
+			return nil, err
+		}
+		clients = append(clients, cleanupClient{Client: client, name: graphserver.DefaultTenant})
+	}
+
+	for _, t := range tenants {
+		client, err := graphclient.NewClient(t.Credential)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+
+		domains := make([]string, 0, len(t.Domains))
+		for _, domain := range t.Domains {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		clients = append(clients, cleanupClient{Client: client, name: t.Name, domains: domains})
+	}
+
+	return clients, nil
+}
+
+// cleanupClientFor returns the client of the tenant with a domain matching
+// mailbox, in the same way as senders are routed, otherwise the client of the
+// default tenant, or nil if there is none
+func cleanupClientFor(clients []cleanupClient, mailbox string) *cleanupClient {
+	_, domain, _ := strings.Cut(strings.ToLower(mailbox), "@")
+	for i, client := range clients {
+		for _, pattern := range client.domains {
+			if ok, _ := path.Match(pattern, domain); ok {
+				return &clients[i]
+			}
+		}
+	}
+
+	for i, client := range clients {
+		if client.name == graphserver.DefaultTenant {
+			return &clients[i]
+		}
+	}
+
+	return nil
+}
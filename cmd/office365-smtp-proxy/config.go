@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+)
+
+// Graph credential modes
+const (
+	credentialSecret      = "secret"
+	credentialCertificate = "certificate"
+	credentialWorkload    = "workload"
+	credentialManaged     = "managed"
+)
+
+// addGraphFlags adds the Entra ID options to flags
+func addGraphFlags(flags *pflag.FlagSet) {
+	flags.String("clientid", "", "App Registration Client/Application ID")
+	flags.String("tenantid", "", "App Registration Tenant ID")
+	flags.String("credential", credentialSecret, "Graph credential type (secret, certificate, workload or managed)")
+	flags.String("secret", "", "App Registration Client Secret")
+	flags.String("certificate", "", "App Registration client certificate (PEM or PFX) including private key")
+	flags.String("certificate-password", "", "Password for the client certificate private key")
+	flags.String("token-file", "", "Federated token file for workload identity (defaults to AZURE_FEDERATED_TOKEN_FILE)")
+}
+
+// credentialConfig is the configuration of a Graph credential
+type credentialConfig struct {
+	TenantID            string `mapstructure:"tenantid"`
+	ClientID            string `mapstructure:"clientid"`
+	Credential          string `mapstructure:"credential"`
+	Secret              string `mapstructure:"secret"`
+	SecretFile          string `mapstructure:"secret_file"`
+	Certificate         string `mapstructure:"certificate"`
+	CertificatePassword string `mapstructure:"certificate_password"`
+	TokenFile           string `mapstructure:"token_file"`
+}
+
+// tenantConfig is a named Graph credential from the tenants config file key
+type tenantConfig struct {
+	Name             string   `mapstructure:"name"`
+	Domains          []string `mapstructure:"domains"`
+	Users            []string `mapstructure:"users"`
+	credentialConfig `mapstructure:",squash"`
+}
+
+// graphCredential returns the Graph credential option selected by config
+func graphCredential() (graphclient.ClientOption, error) {
+	return newCredential(credentialConfig{
+		TenantID:            viper.GetString("tenantid"),
+		ClientID:            viper.GetString("clientid"),
+		Credential:          viper.GetString("credential"),
+		Secret:              viper.GetString("secret"),
+		Certificate:         viper.GetString("certificate"),
+		CertificatePassword: viper.GetString("certificate-password"),
+		TokenFile:           viper.GetString("token-file"),
+	})
+}
+
+// hasDefaultCredential reports whether the top level Graph options are set,
+// which are not required when tenants are configured
+func hasDefaultCredential() bool {
+	switch strings.ToLower(viper.GetString("credential")) {
+	case "", credentialSecret:
+		return viper.GetString("tenantid") != "" || viper.GetString("clientid") != "" || viper.GetString("secret") != ""
+	default:
+		return true
+	}
+}
+
+// graphTenants returns the named Graph credentials from the config file
+func graphTenants() ([]graphserver.Tenant, error) {
+	var configs []tenantConfig
+	if err := viper.UnmarshalKey("tenants", &configs); err != nil {
+		return nil, err
+	}
+
+	tenants := make([]graphserver.Tenant, 0, len(configs))
+	for _, config := range configs {
+		if config.Secret == "" && config.SecretFile != "" {
+			b, err := os.ReadFile(config.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read secret file for tenant %q: %w", config.Name, err)
+			}
+			config.Secret = strings.TrimSpace(string(b))
+		}
+
+		cred, err := newCredential(config.credentialConfig)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", config.Name, err)
+		}
+
+		tenants = append(tenants, graphserver.Tenant{
+			Name:       config.Name,
+			Credential: cred,
+			Domains:    config.Domains,
+			Users:      config.Users,
+		})
+	}
+
+	return tenants, nil
+}
+
+// newCredential returns the Graph credential option for config
+func newCredential(config credentialConfig) (graphclient.ClientOption, error) {
+	tenantid := config.TenantID
+	clientid := config.ClientID
+
+	switch mode := strings.ToLower(config.Credential); mode {
+	case "", credentialSecret:
+		return graphclient.WithClientSecret(tenantid, clientid, config.Secret), nil
+	case credentialCertificate:
+		return graphclient.WithClientCertificate(tenantid, clientid, config.Certificate, config.CertificatePassword), nil
+	case credentialWorkload:
+		// fall back to the variables set by the Azure workload identity webhook
+		if tenantid == "" {
+			tenantid = os.Getenv("AZURE_TENANT_ID")
+		}
+		if clientid == "" {
+			clientid = os.Getenv("AZURE_CLIENT_ID")
+		}
+		tokenFile := config.TokenFile
+		if tokenFile == "" {
+			tokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		}
+		return graphclient.WithWorkloadIdentity(tenantid, clientid, tokenFile), nil
+	case credentialManaged:
+		return graphclient.WithManagedIdentity(clientid), nil
+	default:
+		return nil, fmt.Errorf("invalid credential type %q", mode)
+	}
+}
+
+// loadConfig binds flags and environment variables to viper, loads the config
+// file and resolves the client secret, exiting on any fatal error
+func loadConfig(logger *slog.Logger, flags *pflag.FlagSet) {
+	// viper setup
+	viper.SetEnvPrefix("office365_smtp_proxy")
+	viper.AutomaticEnv()
+	viper.BindPFlags(flags)
+
+	// load config file
+	config := viper.GetString("config")
+	if config != "" {
+		viper.SetConfigFile(config)
+	} else {
+		viper.SetConfigName("config")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath(".")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			if config != "" {
+				logger.Error("config file not found", "error", err, "config", config)
+				os.Exit(1)
+			} else {
+				logger.Info("running without config")
+			}
+		} else {
+			logger.Error("config file was invalid", "error", err, "config", viper.ConfigFileUsed())
+			os.Exit(1)
+		}
+	} else {
+		logger.Info("config file loaded", "config", viper.ConfigFileUsed())
+	}
+
+	// check secret was set, otherwise try the _FILE variation
+	if viper.GetString("secret") == "" && viper.GetString("secret_file") != "" {
+		// read from OFFICE365_SMTP_PROXY_SECRET_FILE
+		b, err := os.ReadFile(viper.GetString("secret_file"))
+		if err == nil {
+			// if that worked then set OFFICE365_SMTP_PROXY_SECRET
+			viper.Set("secret", strings.TrimSpace(string(b)))
+		} else {
+			// not a fatal error at this point
+			logger.Warn("could not read", "secret_file", viper.GetString("secret_file"), "error", err)
+		}
+	}
+}
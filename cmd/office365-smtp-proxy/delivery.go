@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+	"github.com/tombull/office365-smtp-proxy/pkg/maildir"
+	"github.com/tombull/office365-smtp-proxy/pkg/relayclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/webhook"
+)
+
+// Delivery backends
+const (
+	deliveryGraph     = "graph"
+	deliverySmarthost = "smarthost"
+	deliveryMaildir   = "maildir"
+	deliveryWebhook   = "webhook"
+)
+
+// addDeliveryFlags adds the delivery backend options to flags
+func addDeliveryFlags(flags *pflag.FlagSet) {
+	flags.String("delivery", deliveryGraph, "Delivery backend (graph, smarthost, maildir or webhook)")
+	flags.String("fallback", "", "Fallback route when delivery fails with a transient or authentication error (smarthost)")
+	flags.String("smarthost", "", "Upstream SMTP relay address as host:port")
+	flags.String("smarthost-tls", relayclient.TLSStartTLS, "Upstream SMTP relay TLS mode (starttls, tls or none)")
+	flags.String("smarthost-username", "", "Upstream SMTP relay username")
+	flags.String("smarthost-password", "", "Upstream SMTP relay password")
+	flags.String("maildir", "", "Maildir directory messages are written to")
+	flags.String("webhook-url", "", "URL messages are POSTed to as JSON")
+	flags.StringToString("webhook-headers", map[string]string{}, "Headers added to webhook requests, such as Authorization")
+}
+
+// deliverySender returns the sender for the delivery backend selected by
+// config, or nil for Graph
+func deliverySender() (graphserver.Sender, error) {
+	switch mode := strings.ToLower(viper.GetString("delivery")); mode {
+	case "", deliveryGraph:
+		return nil, nil
+	case deliverySmarthost:
+		return smarthostSender()
+	case deliveryMaildir:
+		if viper.GetString("maildir") == "" {
+			return nil, fmt.Errorf("maildir delivery requires a maildir directory")
+		}
+		return maildir.New(viper.GetString("maildir"))
+	case deliveryWebhook:
+		opts := make([]webhook.ClientOption, 0)
+		for key, value := range viper.GetStringMapString("webhook-headers") {
+			opts = append(opts, webhook.WithHeader(key, value))
+		}
+		return webhook.New(viper.GetString("webhook-url"), opts...)
+	default:
+		return nil, fmt.Errorf("invalid delivery backend %q", mode)
+	}
+}
+
+// fallbackSender returns the sender for the fallback route selected by config,
+// or nil if there is none
+func fallbackSender() (graphserver.Sender, error) {
+	switch mode := strings.ToLower(viper.GetString("fallback")); mode {
+	case "":
+		return nil, nil
+	case deliverySmarthost:
+		if strings.ToLower(viper.GetString("delivery")) == deliverySmarthost {
+			return nil, fmt.Errorf("the smarthost cannot be both the delivery backend and the fallback")
+		}
+		return smarthostSender()
+	default:
+		return nil, fmt.Errorf("invalid fallback route %q", mode)
+	}
+}
+
+// smarthostSender returns a client for the upstream SMTP relay
+func smarthostSender() (*relayclient.Client, error) {
+	if viper.GetString("smarthost") == "" {
+		return nil, fmt.Errorf("smarthost delivery requires a smarthost address")
+	}
+
+	opts := []relayclient.ClientOption{
+		relayclient.WithTLS(viper.GetString("smarthost-tls")),
+		relayclient.WithLocalName(viper.GetString("domain")),
+	}
+	if username := viper.GetString("smarthost-username"); username != "" {
+		opts = append(opts, relayclient.WithAuth(username, viper.GetString("smarthost-password")))
+	}
+
+	return relayclient.New(viper.GetString("smarthost"), opts...)
+}
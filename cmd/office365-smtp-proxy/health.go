@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
+)
+
+// health serves the liveness and readiness probes on the metrics listener
+type health struct {
+	be     *graphserver.Backend
+	spool  *spool.Spool
+	maxAge time.Duration
+
+	listening atomic.Bool
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	checkErr  error
+}
+
+// checked records the result of a Graph check
+func (h *health) checked(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checkErr = err
+	if err == nil {
+		h.lastCheck = time.Now()
+	}
+}
+
+// run checks that Graph accepts requests until ctx is done
+func (h *health) run(ctx context.Context) error {
+	interval := min(h.maxAge/2, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		h.checked(h.be.CheckGraph(checkCtx))
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthz reports that the process is alive
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the SMTP listeners are accepting connections, Graph
+// accepted a request recently and the spool, if any, is writable
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	failed := make([]string, 0)
+
+	if !h.listening.Load() {
+		failed = append(failed, "smtp: not listening")
+	}
+
+	h.mu.Lock()
+	lastCheck, checkErr := h.lastCheck, h.checkErr
+	h.mu.Unlock()
+	if h.maxAge > 0 && time.Since(lastCheck) > h.maxAge {
+		msg := "graph: no request accepted within " + h.maxAge.String()
+		if checkErr != nil {
+			msg += ": " + checkErr.Error()
+		}
+		failed = append(failed, msg)
+	}
+
+	if h.spool != nil {
+		if err := h.spool.Check(); err != nil {
+			failed = append(failed, "spool: "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		http.Error(w, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
+)
+
+// pingSender is a sender whose Graph check returns err
+type pingSender struct {
+	err   error
+	pings atomic.Int32
+}
+
+func (s *pingSender) SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error {
+	return nil
+}
+
+func (s *pingSender) Ping(ctx context.Context) error {
+	s.pings.Add(1)
+	return s.err
+}
+
+func newTestBackend(t *testing.T, sender graphserver.Sender) *graphserver.Backend {
+	t.Helper()
+
+	be, err := graphserver.NewBackend(sender, graphserver.WithPrometheusRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+
+	return be
+}
+
+func TestReadyz(t *testing.T) {
+	writable, err := spool.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("spool.New() error = %v", err)
+	}
+	dir := t.TempDir()
+	removed, err := spool.New(dir)
+	if err != nil {
+		t.Fatalf("spool.New() error = %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		listening  bool
+		maxAge     time.Duration
+		lastCheck  time.Duration
+		checkErr   error
+		spool      *spool.Spool
+		wantStatus int
+		wantBody   string
+	}{
+		{"ready", true, time.Minute, time.Second, nil, writable, http.StatusOK, "ok"},
+		{"not listening", false, time.Minute, time.Second, nil, nil, http.StatusServiceUnavailable, "smtp: not listening"},
+		{"graph check too old", true, time.Minute, 2 * time.Minute, nil, nil, http.StatusServiceUnavailable, "graph: no request accepted within 1m0s"},
+		{"graph check failing", true, time.Minute, 2 * time.Minute, errors.New("token expired"), nil, http.StatusServiceUnavailable, "token expired"},
+		{"failure within max age", true, time.Minute, time.Second, errors.New("token expired"), nil, http.StatusOK, "ok"},
+		{"graph check disabled", true, 0, 24 * time.Hour, nil, nil, http.StatusOK, "ok"},
+		{"spool not writable", true, time.Minute, time.Second, nil, removed, http.StatusServiceUnavailable, "spool: spool is not writable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &health{spool: tt.spool, maxAge: tt.maxAge, lastCheck: time.Now().Add(-tt.lastCheck), checkErr: tt.checkErr}
+			h.listening.Store(tt.listening)
+
+			rec := httptest.NewRecorder()
+			h.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("readyz() status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("readyz() body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHealthRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantReady bool
+	}{
+		{"graph accepts requests", nil, true},
+		{"graph fails", errors.New("token expired"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &pingSender{err: tt.err}
+			h := &health{be: newTestBackend(t, sender), maxAge: 100 * time.Millisecond}
+			h.listening.Store(true)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- h.run(ctx) }()
+
+			// checks are made immediately and then every half of maxAge
+			deadline := time.Now().Add(5 * time.Second)
+			for sender.pings.Load() < 3 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if got := sender.pings.Load(); got < 3 {
+				t.Fatalf("run() checked Graph %d times, want at least 3", got)
+			}
+
+			h.mu.Lock()
+			checkErr := h.checkErr
+			h.mu.Unlock()
+			if !errors.Is(checkErr, tt.err) {
+				t.Errorf("run() recorded error %v, want %v", checkErr, tt.err)
+			}
+
+			rec := httptest.NewRecorder()
+			h.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if ready := rec.Code == http.StatusOK; ready != tt.wantReady {
+				t.Errorf("readyz() ready = %v, want %v: %s", ready, tt.wantReady, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/spf13/viper"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+)
+
+// Listener modes
+const (
+	modePlain    = "plain"
+	modeSTARTTLS = "starttls"
+	modeTLS      = "tls"
+)
+
+// listenerConfig is an SMTP listener from the listeners config file key
+type listenerConfig struct {
+	Name        string   `mapstructure:"name"`
+	Addr        string   `mapstructure:"addr"`
+	Mode        string   `mapstructure:"mode"`
+	RequireTLS  bool     `mapstructure:"require_tls"`
+	RequireAuth bool     `mapstructure:"require_auth"`
+	Sources     []string `mapstructure:"sources"`
+	DenySources []string `mapstructure:"deny_sources"`
+}
+
+// loadListeners returns the listeners from the config file, or if there are
+// none a single listener on --addr offering STARTTLS when a certificate is set
+func loadListeners(tlsEnabled bool) ([]listenerConfig, error) {
+	var listeners []listenerConfig
+	if err := viper.UnmarshalKey("listeners", &listeners); err != nil {
+		return nil, err
+	}
+
+	if len(listeners) == 0 {
+		mode := modePlain
+		if tlsEnabled {
+			mode = modeSTARTTLS
+		}
+		return []listenerConfig{{Name: "default", Addr: viper.GetString("addr"), Mode: mode}}, nil
+	}
+
+	names := make(map[string]bool)
+	for i := range listeners {
+		l := &listeners[i]
+		l.Mode = strings.ToLower(strings.TrimSpace(l.Mode))
+		if l.Name == "" {
+			l.Name = l.Addr
+		}
+		if l.Addr == "" {
+			return nil, fmt.Errorf("listener %d must have an address", i+1)
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("duplicate listener %q", l.Name)
+		}
+		names[l.Name] = true
+
+		switch l.Mode {
+		case "":
+			l.Mode = modePlain
+			if tlsEnabled {
+				l.Mode = modeSTARTTLS
+			}
+		case modePlain, modeSTARTTLS, modeTLS:
+		default:
+			return nil, fmt.Errorf("invalid mode %q for listener %q", l.Mode, l.Name)
+		}
+
+		if l.Mode != modePlain && !tlsEnabled {
+			return nil, fmt.Errorf("listener %q requires a certificate and key for %s", l.Name, l.Mode)
+		}
+		if l.Mode == modePlain && l.RequireTLS {
+			return nil, fmt.Errorf("listener %q cannot require TLS in plain mode", l.Name)
+		}
+	}
+
+	return listeners, nil
+}
+
+// newServer returns the SMTP server for l sharing be
+func newServer(be *graphserver.Backend, l listenerConfig, tlsConfig *tls.Config) (*smtp.Server, error) {
+	lb, err := be.ForListener(graphserver.Listener{
+		Name:           l.Name,
+		AllowedSources: l.Sources,
+		DeniedSources:  l.DenySources,
+		RequireAuth:    l.RequireAuth,
+		RequireTLS:     l.RequireTLS,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := smtp.NewServer(lb)
+	s.Addr = l.Addr
+	s.Domain = viper.GetString("domain")
+	s.MaxRecipients = viper.GetInt("recipients")
+	s.MaxMessageBytes = viper.GetInt64("max")
+	s.AllowInsecureAuth = viper.GetBool("insecure-auth") && !l.RequireTLS && !viper.GetBool("require-tls")
+	s.ReadTimeout = viper.GetDuration("idle-timeout")
+	s.WriteTimeout = viper.GetDuration("write-timeout")
+	if l.Mode != modePlain {
+		s.TLSConfig = tlsConfig
+	}
+
+	return s, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLoadListeners(t *testing.T) {
+	tests := []struct {
+		name       string
+		listeners  []map[string]any
+		tlsEnabled bool
+		want       []listenerConfig
+		wantErr    bool
+	}{
+		{
+			name: "default plain",
+			want: []listenerConfig{{Name: "default", Addr: "localhost:2525", Mode: modePlain}},
+		},
+		{
+			name:       "default starttls",
+			tlsEnabled: true,
+			want:       []listenerConfig{{Name: "default", Addr: "localhost:2525", Mode: modeSTARTTLS}},
+		},
+		{
+			name: "configured",
+			listeners: []map[string]any{
+				{"name": "devices", "addr": ":25", "sources": []string{"10.0.0.0/8"}},
+				{"addr": ":465", "mode": " TLS ", "require_auth": true},
+				{"name": "submission", "addr": ":587", "mode": "starttls", "require_tls": true},
+			},
+			tlsEnabled: true,
+			want: []listenerConfig{
+				{Name: "devices", Addr: ":25", Mode: modeSTARTTLS, Sources: []string{"10.0.0.0/8"}},
+				{Name: ":465", Addr: ":465", Mode: modeTLS, RequireAuth: true},
+				{Name: "submission", Addr: ":587", Mode: modeSTARTTLS, RequireTLS: true},
+			},
+		},
+		{
+			name:      "plain without certificate",
+			listeners: []map[string]any{{"name": "devices", "addr": ":25"}},
+			want:      []listenerConfig{{Name: "devices", Addr: ":25", Mode: modePlain}},
+		},
+		{name: "missing address", listeners: []map[string]any{{"name": "devices"}}, wantErr: true},
+		{name: "duplicate name", listeners: []map[string]any{{"name": "a", "addr": ":25"}, {"name": "a", "addr": ":26"}}, wantErr: true},
+		{name: "invalid mode", listeners: []map[string]any{{"addr": ":25", "mode": "ssl"}}, tlsEnabled: true, wantErr: true},
+		{name: "tls without certificate", listeners: []map[string]any{{"addr": ":465", "mode": "tls"}}, wantErr: true},
+		{name: "plain requiring tls", listeners: []map[string]any{{"addr": ":25", "mode": "plain", "require_tls": true}}, tlsEnabled: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+			viper.Set("addr", "localhost:2525")
+			if tt.listeners != nil {
+				viper.Set("listeners", tt.listeners)
+			}
+
+			got, err := loadListeners(tt.tlsEnabled)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadListeners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadListeners() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
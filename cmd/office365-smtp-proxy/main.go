@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/andrewheberle/redacted-string"
 	"github.com/cloudflare/certinel/fswatcher"
@@ -17,36 +22,85 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
 	"github.com/tombull/office365-smtp-proxy/pkg/graphserver"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
 )
 
 func main() {
+	// run subcommands
+	if len(os.Args) > 1 && os.Args[1] == "drafts-cleanup" {
+		draftsCleanup(os.Args[2:])
+		return
+	}
+
 	// general options
 	pflag.Bool("debug", false, "Enable debug mode")
 	pflag.String("config", "", "Configuration file")
 
 	// SMTP options
-	pflag.String("addr", "localhost:2525", "Service listen address")
+	pflag.String("addr", "localhost:2525", "Service listen address, unless listeners are set in the config file")
 	pflag.String("domain", "localhost", "Service domain/hostname")
 	pflag.Int("recipients", 10, "Maximum message recipients")
 	pflag.Int64("max", 1024*1024*20, "Maximum message size in bytes")
+	pflag.String("envelope", graphserver.EnvelopeOverride, "How the SMTP envelope is applied to MIME headers (override or preserve)")
+	pflag.Duration("shutdown-grace", 30*time.Second, "Time to wait for messages in progress to finish on shutdown")
+	pflag.Duration("idle-timeout", 5*time.Minute, "Time to wait for the next SMTP command before closing the connection")
+	pflag.Duration("read-timeout", 3*time.Minute, "Time to wait for each read of message data during DATA")
+	pflag.Duration("write-timeout", time.Minute, "Time to wait for each SMTP reply to be written")
 
 	// Access controls
 	pflag.StringSlice("senders", []string{}, "List of allowed senders")
 	pflag.String("senduser", "", "Graph user ID to send as for all relayed messages")
-	pflag.StringSlice("sources", []string{}, "Source IP addresses allowed to relay")
+	pflag.StringSlice("sources", []string{}, "Source IP addresses, CIDR blocks or hostnames allowed to relay")
+	pflag.StringSlice("deny-sources", []string{}, "Source IP addresses, CIDR blocks or hostnames that are always rejected")
+	pflag.String("users", "", "Users file for SMTP AUTH")
+	pflag.StringSlice("recipient-domains", []string{}, "Recipient domains messages may be relayed to")
+	pflag.Bool("internal-only", false, "Only relay to the verified domains of the tenant")
+	pflag.String("unauthenticated", graphserver.RelaySources, "Unauthenticated relaying when SMTP AUTH is enabled (sources or disabled)")
+	pflag.Bool("insecure-auth", false, "Allow SMTP AUTH without TLS")
+
+	// Rate limits
+	pflag.String("rate-limit-global", "", "Rate limit for all messages, as count/duration (eg 600/1h)")
+	pflag.String("rate-limit-source", "", "Rate limit for messages from each source IP address, as count/duration")
+	pflag.String("rate-limit-sender", "", "Rate limit for messages from each envelope sender, as count/duration")
 
 	// TLS options
 	pflag.String("cert", "", "TLS certificate for STARTTLS")
 	pflag.String("key", "", "TLS key for STARTTLS")
+	pflag.Bool("require-tls", false, "Refuse AUTH and MAIL FROM on connections that are not encrypted")
+	pflag.StringSlice("require-tls-exempt", []string{}, "Source IP addresses, CIDR blocks or hostnames exempt from --require-tls")
+	pflag.String("tls-min-version", "1.2", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	pflag.StringSlice("tls-ciphers", []string{}, "Allowed TLS 1.2 and earlier cipher suites (defaults to the Go defaults)")
+	pflag.String("client-auth", "none", "Client certificate authentication (none, request or require)")
+	pflag.String("client-ca", "", "CA bundle used to verify client certificates")
 
 	// Entra ID options
-	pflag.String("clientid", "", "App Registration Client/Application ID")
-	pflag.String("tenantid", "", "App Registration Tenant ID")
-	pflag.String("secret", "", "App Registration Client Secret")
+	addGraphFlags(pflag.CommandLine)
+	pflag.Int("graph-retries", 3, "Retries for each Graph request after throttling or transient errors")
+	pflag.Duration("graph-timeout", 5*time.Minute, "Deadline for sending each message through Graph, including retries")
+	pflag.Int("max-sends", 32, "Maximum messages sent at once (0 for unlimited)")
+	pflag.Int("max-sends-per-user", 4, "Maximum messages sent at once as each Graph user (0 for unlimited)")
+	pflag.Duration("send-queue-timeout", 0, "Time a message may wait for a free send slot (0 uses the graph timeout)")
+	pflag.Bool("check-credentials", true, "Check that a Graph token can be obtained for each credential at startup")
+	pflag.Bool("check-send-users", false, "Check that the send user and send user route users exist at startup")
+
+	// Delivery options
+	addDeliveryFlags(pflag.CommandLine)
+
+	// Spool options
+	pflag.String("spool", "", "Spool directory for asynchronous delivery")
+	pflag.Duration("spool-expiry", 24*time.Hour, "Time to retry spooled messages before giving up")
+	pflag.Duration("spool-retry", time.Minute, "Initial delay between spooled delivery attempts")
+	pflag.Duration("spool-retry-max", time.Hour, "Maximum delay between spooled delivery attempts")
+	pflag.Int("spool-workers", 4, "Spooled messages delivered at once")
+	pflag.Bool("bounces", true, "Send bounces to the envelope sender of spooled messages that fail")
+	pflag.String("bounce-sender", "", "Address bounces are sent from (defaults to the Graph send user, which must then be a mailbox)")
+	pflag.StringSlice("no-bounce-senders", graphserver.DefaultNoBounceSenders, "Envelope sender patterns that are never sent bounces")
 
 	// metrics
-	pflag.String("metrics", "", "Listen address for metrics")
+	pflag.String("metrics", "", "Listen address for metrics and health checks")
+	pflag.Duration("ready-max-age", 5*time.Minute, "Maximum time since Graph last accepted a request for the service to be ready (0 to disable)")
 
 	// parse flags
 	pflag.Parse()
@@ -54,41 +108,73 @@ func main() {
 	// set up logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	// viper setup
-	viper.SetEnvPrefix("office365_smtp_proxy")
-	viper.AutomaticEnv()
-	viper.BindPFlags(pflag.CommandLine)
+	// load config
+	loadConfig(logger, pflag.CommandLine)
 
-	// load config file
-	config := viper.GetString("config")
-	if config != "" {
-		viper.SetConfigFile(config)
-	} else {
-		viper.SetConfigName("config")
-		viper.SetConfigType("yaml")
-		viper.AddConfigPath(".")
-	}
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			if config != "" {
-				logger.Error("config file not found", "error", err, "config", config)
-				os.Exit(1)
-			} else {
-				logger.Info("running without config")
-			}
-		} else {
-			logger.Error("config file was invalid", "error", err, "config", viper.ConfigFileUsed())
-			os.Exit(1)
-		}
-	} else {
-		logger.Info("config file loaded", "config", viper.ConfigFileUsed())
+	// load sender rewrite rules, which are only supported in the config file
+	var rewrites []graphserver.RewriteRule
+	if err := viper.UnmarshalKey("rewrite", &rewrites); err != nil {
+		logger.Error("invalid rewrite rules", "error", err)
+		os.Exit(1)
+	}
+
+	// load client certificate identities
+	var identities []graphserver.CertIdentity
+	if err := viper.UnmarshalKey("client_certs", &identities); err != nil {
+		logger.Error("invalid client certificate identities", "error", err)
+		os.Exit(1)
+	}
+
+	// load send user routes
+	var routes []graphserver.SendUserRoute
+	if err := viper.UnmarshalKey("send_users", &routes); err != nil {
+		logger.Error("invalid send user routes", "error", err)
+		os.Exit(1)
+	}
+
+	// load recipient policies, with the command line options applying to
+	// anything not matched by a policy from the config file
+	var policies []graphserver.RecipientPolicy
+	if err := viper.UnmarshalKey("recipient_policies", &policies); err != nil {
+		logger.Error("invalid recipient policies", "error", err)
+		os.Exit(1)
+	}
+	if domains := viper.GetStringSlice("recipient-domains"); len(domains) > 0 || viper.GetBool("internal-only") {
+		policies = append(policies, graphserver.RecipientPolicy{
+			AllowDomains: domains,
+			InternalOnly: viper.GetBool("internal-only"),
+		})
 	}
 
 	// set backend options
 	opts := []graphserver.BackendOption{
+		graphserver.WithRewriteRules(rewrites),
 		graphserver.WithAllowedSenders(viper.GetStringSlice("senders")),
+		graphserver.WithRecipientPolicies(policies),
 		graphserver.WithSendUser(viper.GetString("senduser")),
+		graphserver.WithSendUserRoutes(routes),
 		graphserver.WithAllowedSources(viper.GetStringSlice("sources")),
+		graphserver.WithDeniedSources(viper.GetStringSlice("deny-sources")),
+		graphserver.WithEnvelopeMode(viper.GetString("envelope")),
+		graphserver.WithUsersFile(viper.GetString("users")),
+		graphserver.WithUnauthenticatedRelay(viper.GetString("unauthenticated")),
+		graphserver.WithRequireTLS(viper.GetBool("require-tls")),
+		graphserver.WithTLSExemptions(viper.GetStringSlice("require-tls-exempt")),
+		graphserver.WithCertIdentities(identities),
+		graphserver.WithRateLimits(map[string]string{
+			graphserver.LimitGlobal: viper.GetString("rate-limit-global"),
+			graphserver.LimitSource: viper.GetString("rate-limit-source"),
+			graphserver.LimitSender: viper.GetString("rate-limit-sender"),
+		}),
+		graphserver.WithGraphRetries(viper.GetInt("graph-retries")),
+		graphserver.WithGraphTimeout(viper.GetDuration("graph-timeout")),
+		graphserver.WithConcurrencyLimits(viper.GetInt("max-sends"), viper.GetInt("max-sends-per-user")),
+		graphserver.WithSendQueueTimeout(viper.GetDuration("send-queue-timeout")),
+		graphserver.WithReadTimeout(viper.GetDuration("read-timeout")),
+		graphserver.WithDomain(viper.GetString("domain")),
+		graphserver.WithBounces(viper.GetBool("bounces")),
+		graphserver.WithBounceSender(viper.GetString("bounce-sender")),
+		graphserver.WithNoBounceSenders(viper.GetStringSlice("no-bounce-senders")),
 		graphserver.WithLogger(logger),
 	}
 
@@ -104,24 +190,69 @@ func main() {
 		opts = append(opts, graphserver.WithPrometheusRegistry(reg))
 	}
 
-	// check secret was set, otherwise try the _FILE variation
-	if viper.GetString("secret") == "" && viper.GetString("secret_file") != "" {
-		// read from OFFICE365_SMTP_PROXY_SECRET_FILE
-		b, err := os.ReadFile(viper.GetString("secret_file"))
-		if err == nil {
-			// if that worked then set OFFICE365_SMTP_PROXY_SECRET
-			viper.Set("secret", strings.TrimSpace(string(b)))
-		} else {
-			// not a fatal error at this point
-			logger.Warn("could not read", "secret_file", viper.GetString("secret_file"), "error", err)
+	// set up spool
+	var sp *spool.Spool
+	if dir := viper.GetString("spool"); dir != "" {
+		var err error
+		sp, err = spool.New(dir,
+			spool.WithExpiry(viper.GetDuration("spool-expiry")),
+			spool.WithBackoff(viper.GetDuration("spool-retry"), viper.GetDuration("spool-retry-max")),
+			spool.WithWorkers(viper.GetInt("spool-workers")),
+			spool.WithLogger(logger),
+		)
+		if err != nil {
+			logger.Error("could not set up spool", "error", err, "spool", dir)
+			os.Exit(1)
+		}
+		opts = append(opts, graphserver.WithSpool(sp))
+	}
+
+	// load additional tenants, in which case the top level credential is
+	// optional
+	tenants, err := graphTenants()
+	if err != nil {
+		logger.Error("invalid tenants", "error", err)
+		os.Exit(1)
+	}
+	opts = append(opts, graphserver.WithTenants(tenants))
+
+	// set up the default delivery backend, which is Graph unless another is
+	// selected
+	sender, err := deliverySender()
+	if err != nil {
+		logger.Error("error setting up backend", "error", err, "delivery", viper.GetString("delivery"))
+		os.Exit(1)
+	}
+
+	fallback, err := fallbackSender()
+	if err != nil {
+		logger.Error("error setting up backend", "error", err, "fallback", viper.GetString("fallback"))
+		os.Exit(1)
+	}
+	if fallback != nil {
+		opts = append(opts, graphserver.WithFallback(fallback))
+	}
+
+	var cred graphclient.ClientOption
+	if sender == nil && (len(tenants) == 0 || hasDefaultCredential()) {
+		cred, err = graphCredential()
+		if err != nil {
+			logger.Error("error setting up backend", "error", err, "credential", viper.GetString("credential"))
+			os.Exit(1)
 		}
 	}
 
 	// create backend
-	be, err := graphserver.NewGraphBackend(viper.GetString("clientid"), viper.GetString("tenantid"), viper.GetString("secret"), opts...)
+	var be *graphserver.Backend
+	if sender != nil {
+		be, err = graphserver.NewBackend(sender, opts...)
+	} else {
+		be, err = graphserver.NewGraphBackend(cred, opts...)
+	}
 	if err != nil {
 		logger.Error("error setting up backend",
 			"error", err,
+			"credential", viper.GetString("credential"),
 			"clientid", viper.GetString("clientid"),
 			"tenantid", viper.GetString("tenantid"),
 			"secret", redacted.Redact(viper.GetString("secret")),
@@ -129,18 +260,32 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger.Info("Office365 SMTP Proxy backend created")
+	if viper.GetBool("check-credentials") {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := be.ValidateCredentials(ctx)
+		cancel()
+		if err != nil {
+			logger.Error("graph credential check failed", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if viper.GetBool("check-send-users") {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := be.ValidateSendUsers(ctx)
+		cancel()
+		if err != nil {
+			logger.Error("send user check failed", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	// set up server
-	s := smtp.NewServer(be)
-	s.Addr = viper.GetString("addr")
-	s.Domain = viper.GetString("domain")
-	s.MaxRecipients = viper.GetInt("recipients")
-	s.MaxMessageBytes = viper.GetInt64("max")
+	logger.Info("Office365 SMTP Proxy backend created", "delivery", viper.GetString("delivery"), "fallback", viper.GetString("fallback"))
 
 	// set up run group
 	g := run.Group{}
 
+	var tlsConfig *tls.Config
 	if viper.GetString("cert") != "" && viper.GetString("key") != "" {
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -161,40 +306,180 @@ func main() {
 			cancel()
 		})
 
-		// set up certificate watching for server
-		s.TLSConfig = &tls.Config{
+		minVersion, err := parseTLSVersion(viper.GetString("tls-min-version"))
+		if err != nil {
+			logger.Error("invalid TLS policy", "error", err)
+			os.Exit(1)
+		}
+
+		ciphers, err := parseCipherSuites(viper.GetStringSlice("tls-ciphers"))
+		if err != nil {
+			logger.Error("invalid TLS policy", "error", err)
+			os.Exit(1)
+		}
+
+		auth, clientCAs, err := clientAuth(viper.GetString("client-auth"), viper.GetString("client-ca"))
+		if err != nil {
+			logger.Error("invalid TLS policy", "error", err)
+			os.Exit(1)
+		}
+
+		// set up certificate watching for servers
+		tlsConfig = &tls.Config{
 			GetCertificate: certinel.GetCertificate,
+			MinVersion:     minVersion,
+			CipherSuites:   ciphers,
+			ClientAuth:     auth,
+			ClientCAs:      clientCAs,
+		}
+	} else if viper.GetBool("require-tls") {
+		logger.Error("TLS cannot be required without a certificate and key")
+		os.Exit(1)
+	} else if mode := viper.GetString("client-auth"); mode != "" && mode != clientAuthNone {
+		logger.Error("client certificates cannot be used without a certificate and key")
+		os.Exit(1)
+	}
+
+	// set up servers
+	listeners, err := loadListeners(tlsConfig != nil)
+	if err != nil {
+		logger.Error("invalid listeners", "error", err)
+		os.Exit(1)
+	}
+
+	servers := make([]*smtp.Server, 0, len(listeners))
+	for _, l := range listeners {
+		s, err := newServer(be, l, tlsConfig)
+		if err != nil {
+			logger.Error("could not set up listener", "error", err, "listener", l.Name)
+			os.Exit(1)
 		}
+		servers = append(servers, s)
+	}
+
+	// stop on SIGINT or SIGTERM, which is not an error
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	g.Add(func() error {
+		select {
+		case sig := <-signals:
+			logger.Info("received signal", "signal", sig.String())
+		case <-stopped:
+		}
+		return nil
+	}, func(err error) {
+		signal.Stop(signals)
+		close(stopped)
+	})
+
+	// draining starts as soon as shutdown begins, so that spooled deliveries in
+	// progress are bounded by the grace period as well as SMTP transactions
+	grace := viper.GetDuration("shutdown-grace")
+	drain := sync.OnceValues(func() (int, int) {
+		logger.Info("shutting down", "grace", grace.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		return be.Drain(ctx)
+	})
+
+	// add spool delivery worker, which stops starting deliveries when
+	// interrupted and waits for those in progress to be drained
+	if sp != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		g.Add(func() error {
+			pending, _ := sp.Pending()
+			logger.Info("starting up", "from", "spool", "spool", viper.GetString("spool"), "pending", pending)
+			return sp.Run(ctx, be.Deliver, be.Bounce)
+		}, func(err error) {
+			if err != nil {
+				logger.Error("error on exit", "from", "spool", "error", err)
+			}
+			cancel()
+			go drain()
+		})
 	}
 
 	// set up metrics http listener if set
+	hc := &health{be: be, spool: sp, maxAge: viper.GetDuration("ready-max-age")}
 	if metrics != "" {
+		http.HandleFunc("/healthz", hc.healthz)
+		http.HandleFunc("/readyz", hc.readyz)
+
+		// check that Graph accepts requests for readiness
+		if hc.maxAge > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+
+			g.Add(func() error {
+				return hc.run(ctx)
+			}, func(err error) {
+				cancel()
+			})
+		}
+
+		srv := &http.Server{Addr: metrics}
+
 		g.Add(func() error {
 			logger.Info("starting up", "from", "metrics", "addr", metrics)
-			return http.ListenAndServe(metrics, nil)
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
 		}, func(err error) {
 			if err != nil {
 				logger.Error("error on exit", "from", "metrics", "error", err)
 			}
-			s.Close()
+			srv.Close()
 		})
 	}
 
-	// add SMTP server
-	g.Add(func() error {
-		logger.Info("starting up", "from", "SMTP server", "addr", viper.GetString("addr"), "domain", viper.GetString("domain"))
-		return s.ListenAndServe()
-	}, func(err error) {
+	// add SMTP servers, which only stop accepting connections when
+	// interrupted so that sessions in progress can be drained below
+	for i, s := range servers {
+		l := listeners[i]
+
+		ln, err := net.Listen("tcp", l.Addr)
 		if err != nil {
-			logger.Error("error on exit", "from", "SMTP server", "error", err)
+			logger.Error("could not listen", "error", err, "listener", l.Name, "addr", l.Addr)
+			os.Exit(1)
+		}
+		if l.Mode == modeTLS {
+			ln = tls.NewListener(ln, tlsConfig)
 		}
-		s.Close()
-	})
+
+		g.Add(func() error {
+			logger.Info("starting up", "from", "SMTP server", "listener", l.Name, "addr", l.Addr, "mode", l.Mode, "domain", viper.GetString("domain"))
+			if err := s.Serve(ln); !errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			return nil
+		}, func(err error) {
+			if err != nil {
+				logger.Error("error on exit", "from", "SMTP server", "listener", l.Name, "error", err)
+			}
+			hc.listening.Store(false)
+			ln.Close()
+		})
+	}
+	hc.listening.Store(true)
 
 	logger.Info("starting components")
 
-	if err := g.Run(); err != nil {
-		logger.Error("run group error", "error", err)
+	runErr := g.Run()
+
+	// wait for messages in progress before closing connections
+	drained, aborted := drain()
+
+	for _, s := range servers {
+		s.Close()
+	}
+
+	logger.Info("shutdown complete", "drained", drained, "aborted", aborted)
+
+	if runErr != nil {
+		logger.Error("run group error", "error", runErr)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Client certificate modes
+const (
+	clientAuthNone    = "none"
+	clientAuthRequest = "request"
+	clientAuthRequire = "require"
+)
+
+// tlsVersions maps the accepted --tls-min-version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion returns the TLS version for version, such as "1.2"
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.TrimSpace(version), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q", version)
+	}
+
+	return v, nil
+}
+
+// parseCipherSuites returns the IDs of the named cipher suites, which must be
+// suites supported by crypto/tls such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// Insecure suites are allowed but must be named explicitly.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// clientAuth returns the client certificate policy for mode, verifying
+// certificates against the PEM CA bundle in caFile
+func clientAuth(mode, caFile string) (tls.ClientAuthType, *x509.CertPool, error) {
+	var auth tls.ClientAuthType
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", clientAuthNone:
+		return tls.NoClientCert, nil, nil
+	case clientAuthRequest:
+		auth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		auth = tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert, nil, fmt.Errorf("invalid client certificate mode %q", mode)
+	}
+
+	if caFile == "" {
+		return tls.NoClientCert, nil, fmt.Errorf("client certificates require a CA bundle")
+	}
+
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return tls.NoClientCert, nil, fmt.Errorf("could not read client CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return tls.NoClientCert, nil, fmt.Errorf("no certificates found in client CA bundle %q", caFile)
+	}
+
+	return auth, pool, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"TLS1.0", tls.VersionTLS10, false},
+		{" 1.1 ", tls.VersionTLS11, false},
+		{"", 0, true},
+		{"1.4", 0, true},
+		{"SSL3.0", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTLSVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTLSVersion(%q) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTLSVersion(%q) = %#x, want %#x", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []uint16
+		wantErr bool
+	}{
+		{"none", nil, nil, false},
+		{"secure", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, false},
+		{"case and spaces", []string{" tls_ecdhe_rsa_with_aes_256_gcm_sha384 "}, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, false},
+		{"insecure named explicitly", []string{"TLS_RSA_WITH_AES_128_CBC_SHA"}, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}, false},
+		{"unknown", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_MADE_UP"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCipherSuites(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCipherSuites(%q) error = %v, wantErr %v", tt.names, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseCipherSuites(%q) = %#x, want %#x", tt.names, got, tt.want)
+			}
+		})
+	}
+}
+
+// writeCA writes a self-signed CA certificate to a PEM file in dir
+func writeCA(t *testing.T, dir string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	return path
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCA(t, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		caFile   string
+		want     tls.ClientAuthType
+		wantPool bool
+		wantErr  bool
+	}{
+		{"default", "", "", tls.NoClientCert, false, false},
+		{"none ignores bundle", "none", ca, tls.NoClientCert, false, false},
+		{"request", "request", ca, tls.VerifyClientCertIfGiven, true, false},
+		{"require", " Require ", ca, tls.RequireAndVerifyClientCert, true, false},
+		{"invalid mode", "optional", ca, tls.NoClientCert, false, true},
+		{"missing bundle", "require", "", tls.NoClientCert, false, true},
+		{"unreadable bundle", "require", filepath.Join(dir, "missing.pem"), tls.NoClientCert, false, true},
+		{"no certificates", "require", notPEM, tls.NoClientCert, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, pool, err := clientAuth(tt.mode, tt.caFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientAuth(%q, %q) error = %v, wantErr %v", tt.mode, tt.caFile, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("clientAuth(%q, %q) = %v, want %v", tt.mode, tt.caFile, got, tt.want)
+			}
+			if (pool != nil) != tt.wantPool {
+				t.Errorf("clientAuth(%q, %q) pool = %v, want pool %v", tt.mode, tt.caFile, pool, tt.wantPool)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package graphclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	graphmodels "github.com/microsoftgraph/msgraph-sdk-go/models"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+const (
+	// maxMimeEncodedBytes is the largest Base64 encoded MIME payload Graph will
+	// accept in a single request.
+	maxMimeEncodedBytes = int(3.75 * 1024 * 1024)
+
+	// uploadSessionThreshold is the attachment size from which Graph requires
+	// an upload session rather than a single attachment POST.
+	uploadSessionThreshold = 3 * 1024 * 1024
+
+	// uploadChunkSize must be a multiple of 320 KiB and below 4 MiB.
+	uploadChunkSize = 10 * 320 * 1024
+)
+
+// ErrMessageTooLarge is returned when a MIME message exceeds the single request
+// limit and cannot be reduced by uploading its attachments separately.
+var ErrMessageTooLarge = errors.New("mime message too large")
+
+type attachment struct {
+	name        string
+	contentType string
+	contentID   string
+	inline      bool
+	content     []byte
+}
+
+type mimePart struct {
+	header    textproto.MIMEHeader
+	body      []byte
+	candidate bool
+}
+
+// splitAttachments removes the largest attachments from the top level of a
+// multipart message until the remaining MIME fits in a single Graph request.
+// The reduced MIME and the removed attachments are returned, and the
+// attachments are then uploaded to the draft separately.
+func splitAttachments(mimeMessage []byte) ([]byte, []attachment, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(mimeMessage))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MIME headers: %w", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, nil, fmt.Errorf("%w: message has no attachments to upload separately", ErrMessageTooLarge)
+	}
+
+	headerLen := headerLength(mimeMessage)
+	if headerLen < 0 {
+		return nil, nil, fmt.Errorf("MIME headers were not terminated")
+	}
+
+	parts := make([]*mimePart, 0)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read multipart section: %w", err)
+		}
+
+		parts = append(parts, &mimePart{
+			header:    part.Header,
+			body:      body,
+			candidate: isAttachment(part.Header),
+		})
+	}
+
+	// remove the largest attachments first so as few as possible are uploaded
+	candidates := make([]*mimePart, 0, len(parts))
+	for _, p := range parts {
+		if p.candidate {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i].body) > len(candidates[j].body)
+	})
+
+	removed := make(map[*mimePart]bool)
+	var reduced []byte
+	for {
+		reduced, err = joinParts(mimeMessage[:headerLen], params["boundary"], parts, removed)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if base64.StdEncoding.EncodedLen(len(reduced)) <= maxMimeEncodedBytes {
+			break
+		}
+
+		if len(removed) == len(candidates) {
+			return nil, nil, fmt.Errorf("%w: base64 encoded MIME payload size %d exceeds limit %d without attachments", ErrMessageTooLarge, base64.StdEncoding.EncodedLen(len(reduced)), maxMimeEncodedBytes)
+		}
+
+		removed[candidates[len(removed)]] = true
+	}
+
+	attachments := make([]attachment, 0, len(removed))
+	for n, p := range parts {
+		if !removed[p] {
+			continue
+		}
+
+		a, err := decodeAttachment(p, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return reduced, attachments, nil
+}
+
+// headerLength returns the length of the header block including the blank line
+// that terminates it.
+func headerLength(raw []byte) int {
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return crlf + 4
+	case lf >= 0:
+		return lf + 2
+	}
+
+	return -1
+}
+
+func isAttachment(header textproto.MIMEHeader) bool {
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		return false
+	}
+
+	disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil && (disposition == "attachment" || params["filename"] != "") {
+		return true
+	}
+
+	_, params, err = mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && params["name"] != ""
+}
+
+func joinParts(header []byte, boundary string, parts []*mimePart, removed map[*mimePart]bool) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(header)
+
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, fmt.Errorf("invalid multipart boundary: %w", err)
+	}
+
+	for _, p := range parts {
+		if removed[p] {
+			continue
+		}
+
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return nil, fmt.Errorf("could not write multipart section: %w", err)
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return nil, fmt.Errorf("could not write multipart section: %w", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("could not terminate multipart body: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeAttachment(p *mimePart, n int) (attachment, error) {
+	a := attachment{
+		contentType: "application/octet-stream",
+		contentID:   strings.Trim(p.header.Get("Content-Id"), "<>"),
+	}
+
+	mediaType, typeParams, err := mime.ParseMediaType(p.header.Get("Content-Type"))
+	if err == nil {
+		a.contentType = mediaType
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+	a.inline = disposition == "inline"
+
+	a.name = dispositionParams["filename"]
+	if a.name == "" {
+		a.name = typeParams["name"]
+	}
+	if a.name == "" {
+		a.name = fmt.Sprintf("attachment-%d", n+1)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(p.header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(p.body)))
+		size, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(p.body))
+		if err != nil {
+			return attachment{}, fmt.Errorf("could not decode attachment %q: %w", a.name, err)
+		}
+		a.content = decoded[:size]
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.body)))
+		if err != nil {
+			return attachment{}, fmt.Errorf("could not decode attachment %q: %w", a.name, err)
+		}
+		a.content = decoded
+	default:
+		a.content = p.body
+	}
+
+	return a, nil
+}
+
+func (c *Client) addAttachment(ctx context.Context, userID, messageID string, a attachment) error {
+	if len(a.content) < uploadSessionThreshold {
+		fileAttachment := graphmodels.NewFileAttachment()
+		fileAttachment.SetName(&a.name)
+		fileAttachment.SetContentType(&a.contentType)
+		fileAttachment.SetIsInline(&a.inline)
+		fileAttachment.SetContentBytes(a.content)
+		if a.contentID != "" {
+			fileAttachment.SetContentId(&a.contentID)
+		}
+
+		return c.retry(ctx, "attach", func() error {
+			_, err := c.Users().ByUserId(userID).Messages().ByMessageId(messageID).Attachments().Post(ctx, fileAttachment, &graphusers.ItemMessagesItemAttachmentsRequestBuilderPostRequestConfiguration{
+				Options: noMiddlewareRetry,
+			})
+			return err
+		})
+	}
+
+	return c.uploadAttachment(ctx, userID, messageID, a)
+}
+
+func (c *Client) uploadAttachment(ctx context.Context, userID, messageID string, a attachment) error {
+	size := int64(len(a.content))
+	attachmentType := graphmodels.FILE_ATTACHMENTTYPE
+
+	item := graphmodels.NewAttachmentItem()
+	item.SetAttachmentType(&attachmentType)
+	item.SetName(&a.name)
+	item.SetContentType(&a.contentType)
+	item.SetIsInline(&a.inline)
+	item.SetSize(&size)
+	if a.contentID != "" {
+		item.SetContentId(&a.contentID)
+	}
+
+	body := graphusers.NewItemMessagesItemAttachmentsCreateUploadSessionPostRequestBody()
+	body.SetAttachmentItem(item)
+
+	var session graphmodels.UploadSessionable
+	err := c.retry(ctx, "upload", func() (err error) {
+		session, err = c.Users().ByUserId(userID).Messages().ByMessageId(messageID).Attachments().CreateUploadSession().Post(ctx, body, &graphusers.ItemMessagesItemAttachmentsCreateUploadSessionRequestBuilderPostRequestConfiguration{
+			Options: noMiddlewareRetry,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not create upload session: %w", err)
+	}
+
+	uploadURL := session.GetUploadUrl()
+	if uploadURL == nil || *uploadURL == "" {
+		return fmt.Errorf("graph did not return an upload url")
+	}
+
+	for start := int64(0); start < size; start += uploadChunkSize {
+		end := min(start+uploadChunkSize, size)
+		if err := c.retry(ctx, "upload", func() error {
+			return c.uploadChunk(ctx, *uploadURL, a.content[start:end], start, size)
+		}); err != nil {
+			return fmt.Errorf("could not upload %q bytes %d-%d: %w", a.name, start, end-1, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) uploadChunk(ctx context.Context, uploadURL string, chunk []byte, start, total int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+int64(len(chunk))-1, total))
+	req.ContentLength = int64(len(chunk))
+
+	// the upload url is pre-authenticated so the graph adapter is not used
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return &statusError{
+			statusCode: res.StatusCode,
+			header:     res.Header,
+			message:    strings.TrimSpace(string(msg)),
+		}
+	}
+
+	return nil
+}
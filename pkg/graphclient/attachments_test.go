@@ -0,0 +1,82 @@
+package graphclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSplitAttachmentsRemovesLargeAttachments(t *testing.T) {
+	large := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 2*1024*1024)
+	small := []byte("name,status\r\nsmall,ok\r\n")
+
+	raw := strings.Join([]string{
+		"From: test1@example.com",
+		"To: test2@example.com",
+		"Subject: Scan",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"see attached",
+		"--outer",
+		"Content-Type: application/pdf; name=scan.pdf",
+		"Content-Disposition: attachment; filename=scan.pdf",
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString(large),
+		"--outer",
+		"Content-Type: text/csv",
+		"Content-Disposition: attachment; filename=report.csv",
+		"",
+		strings.TrimSuffix(string(small), "\r\n"),
+		"--outer--",
+		"",
+	}, "\r\n")
+
+	reduced, attachments, err := splitAttachments([]byte(raw))
+	if err != nil {
+		t.Fatalf("splitAttachments() error = %v", err)
+	}
+
+	if encodedLen := base64.StdEncoding.EncodedLen(len(reduced)); encodedLen > maxMimeEncodedBytes {
+		t.Fatalf("reduced MIME encoded length %d exceeds limit %d", encodedLen, maxMimeEncodedBytes)
+	}
+
+	if len(attachments) != 1 {
+		t.Fatalf("splitAttachments() returned %d attachments, want 1", len(attachments))
+	}
+
+	if got := attachments[0]; got.name != "scan.pdf" || got.contentType != "application/pdf" || !bytes.Equal(got.content, large) {
+		t.Fatalf("attachment = %q (%s, %d bytes), want scan.pdf (application/pdf, %d bytes)", got.name, got.contentType, len(got.content), len(large))
+	}
+
+	for _, want := range []string{"Subject: Scan", "see attached", "filename=report.csv", "--outer--"} {
+		if !strings.Contains(string(reduced), want) {
+			t.Fatalf("reduced MIME did not contain %q", want)
+		}
+	}
+
+	if strings.Contains(string(reduced), "scan.pdf") {
+		t.Fatalf("reduced MIME still contained the removed attachment")
+	}
+}
+
+func TestSplitAttachmentsRejectsSinglePart(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: test1@example.com",
+		"To: test2@example.com",
+		"Subject: Large message",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.Repeat("a", 4*1024*1024),
+	}, "\r\n")
+
+	if _, _, err := splitAttachments([]byte(raw)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("splitAttachments() error = %v, want ErrMessageTooLarge", err)
+	}
+}
@@ -0,0 +1,125 @@
+package graphclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// graphScopes are the scopes requested for Graph tokens
+var graphScopes = []string{"https://graph.microsoft.com/.default"}
+
+// WithClientSecret authenticates as an App Registration using a client secret
+func WithClientSecret(tenantid, clientid, secret string) ClientOption {
+	return func(c *Client) {
+		c.credential = func() (azcore.TokenCredential, error) {
+			// error checking
+			if tenantid == "" || clientid == "" || secret == "" {
+				return nil, fmt.Errorf("tenantid, clientid and secret must not be blank")
+			}
+
+			cred, err := azidentity.NewClientSecretCredential(tenantid, clientid, secret, nil)
+			if err != nil {
+				return nil, fmt.Errorf("could not create cred from secret: %w", err)
+			}
+
+			return cred, nil
+		}
+	}
+}
+
+// WithClientCertificate authenticates as an App Registration using a client
+// certificate assertion. The certificate file may be PEM or PFX (PKCS#12) and
+// must contain the private key, which may be protected by password.
+func WithClientCertificate(tenantid, clientid, certificate, password string) ClientOption {
+	return func(c *Client) {
+		c.credential = func() (azcore.TokenCredential, error) {
+			// error checking
+			if tenantid == "" || clientid == "" || certificate == "" {
+				return nil, fmt.Errorf("tenantid, clientid and certificate must not be blank")
+			}
+
+			data, err := os.ReadFile(certificate)
+			if err != nil {
+				return nil, fmt.Errorf("could not read certificate: %w", err)
+			}
+
+			var pass []byte
+			if password != "" {
+				pass = []byte(password)
+			}
+
+			certs, key, err := azidentity.ParseCertificates(data, pass)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse certificate: %w", err)
+			}
+
+			cred, err := azidentity.NewClientCertificateCredential(tenantid, clientid, certs, key, nil)
+			if err != nil {
+				return nil, fmt.Errorf("could not create cred from certificate: %w", err)
+			}
+
+			return cred, nil
+		}
+	}
+}
+
+// WithWorkloadIdentity authenticates as an App Registration using workload
+// identity federation, exchanging the token in tokenFile (such as a projected
+// Kubernetes service account token) for a Graph token.
+func WithWorkloadIdentity(tenantid, clientid, tokenFile string) ClientOption {
+	return func(c *Client) {
+		c.credential = func() (azcore.TokenCredential, error) {
+			// error checking
+			if tenantid == "" || clientid == "" || tokenFile == "" {
+				return nil, fmt.Errorf("tenantid, clientid and token file must not be blank")
+			}
+
+			cred, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+				TenantID:      tenantid,
+				ClientID:      clientid,
+				TokenFilePath: tokenFile,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not create cred from workload identity: %w", err)
+			}
+
+			return cred, nil
+		}
+	}
+}
+
+// WithManagedIdentity authenticates using an Azure managed identity. The
+// clientid selects a user-assigned identity and may be blank to use the
+// system-assigned identity.
+func WithManagedIdentity(clientid string) ClientOption {
+	return func(c *Client) {
+		c.credential = func() (azcore.TokenCredential, error) {
+			opts := &azidentity.ManagedIdentityCredentialOptions{}
+			if clientid != "" {
+				opts.ID = azidentity.ClientID(clientid)
+			}
+
+			cred, err := azidentity.NewManagedIdentityCredential(opts)
+			if err != nil {
+				return nil, fmt.Errorf("could not create cred from managed identity: %w", err)
+			}
+
+			return cred, nil
+		}
+	}
+}
+
+// Validate checks the credential by requesting a Graph token, so that
+// misconfigured credentials are found before any message is sent
+func (c *Client) Validate(ctx context.Context) error {
+	if _, err := c.token.GetToken(ctx, policy.TokenRequestOptions{Scopes: graphScopes}); err != nil {
+		return fmt.Errorf("could not get graph token: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package graphclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+const (
+	// draftHeader is added to the MIME of every draft, so that drafts created
+	// by the proxy can be found again even if it stopped before any later
+	// step of the send pipeline.
+	draftHeader      = "X-Office365-Smtp-Proxy"
+	draftHeaderValue = "draft"
+
+	// draftPropertyID is the extended property Exchange stores draftHeader in,
+	// within the PS_INTERNET_HEADERS property set.
+	draftPropertyID = "String {00020386-0000-0000-C000-000000000046} Name x-office365-smtp-proxy"
+
+	// draftDeleteTimeout bounds the best-effort delete of a failed draft, and
+	// the check of whether a draft was sent, which are made even if the send
+	// context has already been cancelled.
+	draftDeleteTimeout = 30 * time.Second
+)
+
+// ErrSendUnknown is returned when sending a draft failed in a way that leaves
+// it unknown whether Graph accepted the message, so it must not be sent again
+// by another route.
+var ErrSendUnknown = errors.New("message may have been sent")
+
+// tagDraft adds the identifying header to a MIME message
+func tagDraft(mimeMessage []byte) []byte {
+	header := draftHeader + ": " + draftHeaderValue + "\r\n"
+
+	tagged := make([]byte, 0, len(header)+len(mimeMessage))
+	tagged = append(tagged, header...)
+	return append(tagged, mimeMessage...)
+}
+
+// sendRejected reports whether a failed send was rejected by Graph, rather
+// than failing in a way that leaves it unknown whether the draft was sent,
+// such as a timeout, network or server error.
+func sendRejected(err error) bool {
+	code := StatusCode(err)
+	if isThrottled(err) {
+		return true
+	}
+
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout
+}
+
+// checkSent is called when it is unknown whether a draft was sent. The draft is
+// kept, so it is not deleted while Exchange may still be sending it, and err is
+// only returned if the draft has not been sent.
+func (c *Client) checkSent(ctx context.Context, userID, messageID string, err error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), draftDeleteTimeout)
+	defer cancel()
+
+	pending, checkErr := c.draftPending(ctx, userID, messageID)
+	if checkErr != nil {
+		return errors.Join(err, checkErr)
+	}
+	if !pending {
+		return nil
+	}
+
+	return err
+}
+
+// discardDraft deletes a draft after a failed send, so that drafts do not
+// accumulate in the Drafts folder, returning err combined with any error from
+// the delete.
+func (c *Client) discardDraft(ctx context.Context, userID, messageID string, err error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), draftDeleteTimeout)
+	defer cancel()
+
+	if deleteErr := c.deleteDraft(ctx, userID, messageID); deleteErr != nil {
+		return errors.Join(err, fmt.Errorf("could not delete draft %q: %w", messageID, deleteErr))
+	}
+
+	return err
+}
+
+func (c *Client) deleteDraft(ctx context.Context, userID, messageID string) error {
+	return c.retry(ctx, "delete", func() error {
+		return c.Users().ByUserId(userID).Messages().ByMessageId(messageID).Delete(ctx, &graphusers.ItemMessagesMessageItemRequestBuilderDeleteRequestConfiguration{
+			Options: noMiddlewareRetry,
+		})
+	})
+}
+
+// draftPending reports whether messageID is still an unsent draft. A draft
+// that has been sent is moved to Sent Items under a new id, so it is no longer
+// found.
+func (c *Client) draftPending(ctx context.Context, userID, messageID string) (bool, error) {
+	msg, err := c.Users().ByUserId(userID).Messages().ByMessageId(messageID).Get(ctx, &graphusers.ItemMessagesMessageItemRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemMessagesMessageItemRequestBuilderGetQueryParameters{
+			Select: []string{"id", "isDraft"},
+		},
+		Options: noMiddlewareRetry,
+	})
+	if StatusCode(err) == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not look up draft %q: %w", messageID, err)
+	}
+
+	isDraft := msg.GetIsDraft()
+	return isDraft == nil || *isDraft, nil
+}
+
+// CleanupDrafts deletes drafts created by the proxy in the Drafts folder of
+// userID that are older than olderThan, returning the number deleted. These
+// are left behind when the proxy stops part way through sending a message.
+func (c *Client) CleanupDrafts(ctx context.Context, userID string, olderThan time.Duration) (int, error) {
+	userID = strings.TrimSpace(userID)
+	if userID == "" {
+		return 0, fmt.Errorf("userID must not be blank")
+	}
+
+	filter := fmt.Sprintf("singleValueExtendedProperties/any(ep: ep/id eq '%s' and ep/value eq '%s')", draftPropertyID, draftHeaderValue)
+	top := int32(100)
+	config := &graphusers.ItemMailFoldersItemMessagesRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemMailFoldersItemMessagesRequestBuilderGetQueryParameters{
+			Filter: &filter,
+			Select: []string{"id", "createdDateTime"},
+			Top:    &top,
+		},
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	builder := c.Users().ByUserId(userID).MailFolders().ByMailFolderId("drafts").Messages()
+
+	stale := make([]string, 0)
+	for {
+		page, err := builder.Get(ctx, config)
+		if err != nil {
+			return 0, fmt.Errorf("could not list drafts: %w", err)
+		}
+
+		for _, msg := range page.GetValue() {
+			id, created := msg.GetId(), msg.GetCreatedDateTime()
+			if id == nil || created == nil || created.After(cutoff) {
+				continue
+			}
+			stale = append(stale, *id)
+		}
+
+		next := page.GetOdataNextLink()
+		if next == nil || *next == "" {
+			break
+		}
+		builder = builder.WithUrl(*next)
+		config = nil
+	}
+
+	// delete after listing so deletes do not shift the pages being read
+	deleted := 0
+	for _, id := range stale {
+		if err := c.deleteDraft(ctx, userID, id); err != nil {
+			return deleted, fmt.Errorf("could not delete draft %q: %w", id, err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -1,46 +1,81 @@
 package graphclient
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/mail"
 	"strings"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	abstractions "github.com/microsoft/kiota-abstractions-go"
 	graph "github.com/microsoftgraph/msgraph-sdk-go"
 	graphmodels "github.com/microsoftgraph/msgraph-sdk-go/models"
 	odataerrors "github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
 )
 
 type Client struct {
 	graph.GraphServiceClient
+
+	httpClient    *http.Client
+	maxRetries    int
+	maxRetryDelay time.Duration
+	onRetry       func(step string, err error, delay time.Duration)
+	onStep        func(step string, duration time.Duration, err error)
+	sendTimeout   time.Duration
+	credential    func() (azcore.TokenCredential, error)
+	token         azcore.TokenCredential
 }
 
-// NewClient creates a new Graph API client
-func NewClient(tenantid, clientid, secret string) (*Client, error) {
-	// error checking
-	if tenantid == "" || clientid == "" || secret == "" {
-		return nil, fmt.Errorf("tenantid, clientid and secret must not be blank")
+// NewClient creates a new Graph API client. A credential option, such as
+// WithClientSecret or WithManagedIdentity, must be provided.
+func NewClient(opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		httpClient:    http.DefaultClient,
+		maxRetries:    3,
+		maxRetryDelay: 2 * time.Minute,
+	}
+
+	// apply options
+	for _, o := range opts {
+		o(c)
+	}
+
+	if c.credential == nil {
+		return nil, fmt.Errorf("no graph credential was provided")
 	}
 
 	// create graph client
-	cred, err := azidentity.NewClientSecretCredential(tenantid, clientid, secret, nil)
+	cred, err := c.credential()
 	if err != nil {
-		return nil, fmt.Errorf("could not create cred from secret: %w", err)
+		return nil, err
 	}
 
-	client, err := graph.NewGraphServiceClientWithCredentials(cred, []string{"https://graph.microsoft.com/.default"})
+	client, err := graph.NewGraphServiceClientWithCredentials(cred, graphScopes)
 	if err != nil {
 		return nil, fmt.Errorf("could not create client: %w", err)
 	}
 
-	return &Client{*client}, nil
+	c.GraphServiceClient = *client
+	c.token = cred
+
+	return c, nil
+}
+
+// Host returns the host name of the Graph API
+func (c *Client) Host() string {
+	return "graph.microsoft.com"
 }
 
 // SendMime sends a fully formed RFC822 MIME message through Microsoft Graph by
 // creating a MIME draft, patching the From address, and then sending the draft.
-func (c *Client) SendMime(ctx context.Context, graphUserID, fromAddress string, mimeMessage []byte) error {
+// If the draft may have been sent despite an error, the error wraps
+// ErrSendUnknown.
+func (c *Client) SendMime(ctx context.Context, graphUserID, fromAddress string, recipients []string, mimeMessage []byte) error {
 	graphUserID = strings.TrimSpace(graphUserID)
 	if graphUserID == "" {
 		return fmt.Errorf("graphUserID must not be blank")
@@ -55,7 +90,30 @@ func (c *Client) SendMime(ctx context.Context, graphUserID, fromAddress string,
 		return fmt.Errorf("mime message must not be empty")
 	}
 
-	draft, err := c.createMimeDraft(ctx, graphUserID, mimeMessage)
+	if c.sendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.sendTimeout)
+		defer cancel()
+	}
+
+	from := fromRecipient(mimeMessage, fromAddress)
+	bcc := bccRecipients(mimeMessage, recipients)
+	mimeMessage = tagDraft(mimeMessage)
+
+	var attachments []attachment
+	if base64.StdEncoding.EncodedLen(len(mimeMessage)) > maxMimeEncodedBytes {
+		reduced, removed, err := splitAttachments(mimeMessage)
+		if err != nil {
+			return err
+		}
+		mimeMessage, attachments = reduced, removed
+	}
+
+	var draft graphmodels.Messageable
+	err := c.retryThrottled(ctx, "create", func() (err error) {
+		draft, err = c.createMimeDraft(ctx, graphUserID, mimeMessage)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("could not create MIME draft: %w", err)
 	}
@@ -65,12 +123,33 @@ func (c *Client) SendMime(ctx context.Context, graphUserID, fromAddress string,
 		return fmt.Errorf("graph did not return a draft message id")
 	}
 
-	if err := c.patchDraftFrom(ctx, graphUserID, *draftID, fromAddress); err != nil {
-		return fmt.Errorf("could not patch draft from address: %w", err)
+	if err := c.retry(ctx, "patch", func() error {
+		return c.patchDraft(ctx, graphUserID, *draftID, from, bcc)
+	}); err != nil {
+		return c.discardDraft(ctx, graphUserID, *draftID, fmt.Errorf("could not patch draft: %w", err))
+	}
+
+	for _, a := range attachments {
+		if err := c.addAttachment(ctx, graphUserID, *draftID, a); err != nil {
+			return c.discardDraft(ctx, graphUserID, *draftID, fmt.Errorf("could not add attachment %q to draft: %w", a.name, err))
+		}
 	}
 
-	if err := c.sendDraft(ctx, graphUserID, *draftID); err != nil {
-		return fmt.Errorf("could not send draft message: %w", err)
+	attempted := false
+	if err := c.retryThrottled(ctx, "send", func() error {
+		if attempted {
+			pending, err := c.draftPending(ctx, graphUserID, *draftID)
+			if err != nil || !pending {
+				return err
+			}
+		}
+		attempted = true
+		return c.sendDraft(ctx, graphUserID, *draftID)
+	}); err != nil {
+		if !sendRejected(err) {
+			return c.checkSent(ctx, graphUserID, *draftID, fmt.Errorf("could not send draft message, %w: %w", ErrSendUnknown, err))
+		}
+		return c.discardDraft(ctx, graphUserID, *draftID, fmt.Errorf("could not send draft message: %w", err))
 	}
 
 	return nil
@@ -85,6 +164,7 @@ func (c *Client) createMimeDraft(ctx context.Context, userID string, mimeMessage
 	)
 	requestInfo.Headers.TryAdd("Accept", "application/json")
 	requestInfo.SetStreamContentAndContentType(base64Encoded(mimeMessage), "text/plain")
+	requestInfo.AddRequestOptions(noMiddlewareRetry)
 
 	errorMapping := abstractions.ErrorMappings{
 		"4XX": odataerrors.CreateODataErrorFromDiscriminatorValue,
@@ -102,21 +182,89 @@ func (c *Client) createMimeDraft(ctx context.Context, userID string, mimeMessage
 	return res.(graphmodels.Messageable), nil
 }
 
-func (c *Client) patchDraftFrom(ctx context.Context, userID, messageID, fromAddress string) error {
+func (c *Client) patchDraft(ctx context.Context, userID, messageID string, from graphmodels.Recipientable, bcc []string) error {
 	message := graphmodels.NewMessage()
-	fromRecipient := graphmodels.NewRecipient()
-	fromEmail := graphmodels.NewEmailAddress()
-	fromEmail.SetAddress(&fromAddress)
-	fromRecipient.SetEmailAddress(fromEmail)
-	message.SetFrom(fromRecipient)
+	message.SetFrom(from)
+
+	if len(bcc) > 0 {
+		bccRecipients := make([]graphmodels.Recipientable, 0, len(bcc))
+		for _, address := range bcc {
+			bccRecipients = append(bccRecipients, newRecipient(address))
+		}
+		message.SetBccRecipients(bccRecipients)
+	}
 
 	builder := c.Users().ByUserId(userID).Messages().ByMessageId(messageID)
-	_, err := builder.Patch(ctx, message, nil)
+	_, err := builder.Patch(ctx, message, &graphusers.ItemMessagesMessageItemRequestBuilderPatchRequestConfiguration{
+		Options: noMiddlewareRetry,
+	})
 	return err
 }
 
 func (c *Client) sendDraft(ctx context.Context, userID, messageID string) error {
-	return c.Users().ByUserId(userID).Messages().ByMessageId(messageID).Send().Post(ctx, nil)
+	return c.Users().ByUserId(userID).Messages().ByMessageId(messageID).Send().Post(ctx, &graphusers.ItemMessagesItemSendRequestBuilderPostRequestConfiguration{
+		Options: noMiddlewareRetry,
+	})
+}
+
+func newRecipient(address string) graphmodels.Recipientable {
+	email := graphmodels.NewEmailAddress()
+	email.SetAddress(&address)
+	recipient := graphmodels.NewRecipient()
+	recipient.SetEmailAddress(email)
+
+	return recipient
+}
+
+// fromRecipient returns the sender to patch the draft with, including the
+// display name from fromAddress or the From header of the message
+func fromRecipient(mimeMessage []byte, fromAddress string) graphmodels.Recipientable {
+	addr, err := mail.ParseAddress(fromAddress)
+	if err != nil {
+		return newRecipient(fromAddress)
+	}
+
+	if addr.Name == "" {
+		if msg, err := mail.ReadMessage(bytes.NewReader(mimeMessage)); err == nil {
+			original, err := msg.Header.AddressList("From")
+			if err == nil && len(original) == 1 && strings.EqualFold(original[0].Address, addr.Address) {
+				addr.Name = original[0].Name
+			}
+		}
+	}
+
+	recipient := newRecipient(addr.Address)
+	if addr.Name != "" {
+		recipient.GetEmailAddress().SetName(&addr.Name)
+	}
+
+	return recipient
+}
+
+// bccRecipients returns the recipients that are not addressed by the To or Cc
+// headers of the message, which are added to the draft as Bcc recipients.
+func bccRecipients(mimeMessage []byte, recipients []string) []string {
+	msg, err := mail.ReadMessage(bytes.NewReader(mimeMessage))
+	if err != nil {
+		return nil
+	}
+
+	addressed := make(map[string]bool)
+	for _, key := range []string{"To", "Cc"} {
+		addresses, _ := msg.Header.AddressList(key)
+		for _, address := range addresses {
+			addressed[strings.ToLower(address.Address)] = true
+		}
+	}
+
+	bcc := make([]string, 0)
+	for _, recipient := range recipients {
+		if !addressed[strings.ToLower(recipient)] {
+			bcc = append(bcc, recipient)
+		}
+	}
+
+	return bcc
 }
 
 func base64Encoded(content []byte) []byte {
@@ -1,26 +1,36 @@
 package graphclient
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/mail"
 	"testing"
+	"time"
 )
 
 func TestNewClient(t *testing.T) {
 	tests := []struct {
-		name     string
-		tenantid string
-		clientid string
-		secret   string
-		wantErr  bool
+		name    string
+		opts    []ClientOption
+		wantErr bool
 	}{
-		{"missing all", "", "", "", true},
-		{"missing tenantid", "", "clientid", "secret", true},
-		{"missing clientid", "tenantid", "", "secret", true},
-		{"missing secret", "tenantid", "clientid", "", true},
-		{"have all", "tenantid", "clientid", "secret", false},
+		{"no credential", nil, true},
+		{"missing all", []ClientOption{WithClientSecret("", "", "")}, true},
+		{"missing tenantid", []ClientOption{WithClientSecret("", "clientid", "secret")}, true},
+		{"missing clientid", []ClientOption{WithClientSecret("tenantid", "", "secret")}, true},
+		{"missing secret", []ClientOption{WithClientSecret("tenantid", "clientid", "")}, true},
+		{"have all", []ClientOption{WithClientSecret("tenantid", "clientid", "secret")}, false},
+		{"missing certificate", []ClientOption{WithClientCertificate("tenantid", "clientid", "", "")}, true},
+		{"unreadable certificate", []ClientOption{WithClientCertificate("tenantid", "clientid", "does-not-exist.pem", "")}, true},
+		{"missing token file", []ClientOption{WithWorkloadIdentity("tenantid", "clientid", "")}, true},
+		{"workload identity", []ClientOption{WithWorkloadIdentity("tenantid", "clientid", "token")}, false},
+		{"managed identity", []ClientOption{WithManagedIdentity("")}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := NewClient(tt.tenantid, tt.clientid, tt.secret)
+			_, err := NewClient(tt.opts...)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -28,3 +38,172 @@ func TestNewClient(t *testing.T) {
 		})
 	}
 }
+
+func TestBccRecipients(t *testing.T) {
+	mimeMessage := []byte("From: test1@example.com\r\nTo: Alice <Alice@example.com>\r\nCc: carol@example.com\r\nSubject: test\r\n\r\nbody")
+
+	got := bccRecipients(mimeMessage, []string{"alice@example.com", "carol@example.com", "hidden@example.com"})
+	if len(got) != 1 || got[0] != "hidden@example.com" {
+		t.Fatalf("bccRecipients() = %v, want [hidden@example.com]", got)
+	}
+}
+
+func TestFromRecipient(t *testing.T) {
+	mimeMessage := []byte("From: Test User <Test1@example.com>\r\nSubject: test\r\n\r\nbody")
+
+	tests := []struct {
+		from     string
+		wantAddr string
+		wantName string
+	}{
+		{"test1@example.com", "test1@example.com", "Test User"},
+		{"Sender <test1@example.com>", "test1@example.com", "Sender"},
+		{"other@example.com", "other@example.com", ""},
+	}
+
+	for _, tt := range tests {
+		got := fromRecipient(mimeMessage, tt.from).GetEmailAddress()
+		name := ""
+		if got.GetName() != nil {
+			name = *got.GetName()
+		}
+		if *got.GetAddress() != tt.wantAddr || name != tt.wantName {
+			t.Errorf("fromRecipient(%q) = %q <%s>, want %q <%s>", tt.from, name, *got.GetAddress(), tt.wantName, tt.wantAddr)
+		}
+	}
+}
+
+func TestRetryHonoursBudget(t *testing.T) {
+	throttled := &statusError{statusCode: http.StatusTooManyRequests, header: http.Header{"Retry-After": []string{"1"}}}
+
+	tests := []struct {
+		name         string
+		err          error
+		wantAttempts int
+		wantRetries  int
+	}{
+		{"throttled", throttled, 3, 2},
+		{"not transient", &statusError{statusCode: http.StatusNotFound, header: http.Header{}}, 1, 0},
+		{"not a response", errors.New("boom"), 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retries := 0
+			c := &Client{maxRetries: 2, maxRetryDelay: time.Millisecond}
+			WithRetryHook(func(step string, err error, delay time.Duration) {
+				if step != "send" || delay != time.Millisecond {
+					t.Errorf("retry hook called with step %q, delay %v", step, delay)
+				}
+				retries++
+			})(c)
+
+			attempts := 0
+			err := c.retry(context.Background(), "send", func() error {
+				attempts++
+				return tt.err
+			})
+			if err != tt.err {
+				t.Fatalf("retry() error = %v, want %v", err, tt.err)
+			}
+
+			if attempts != tt.wantAttempts || retries != tt.wantRetries {
+				t.Fatalf("retry() made %d attempts with %d retries, want %d and %d", attempts, retries, tt.wantAttempts, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestRetryStepHook(t *testing.T) {
+	throttled := &statusError{statusCode: http.StatusServiceUnavailable, header: http.Header{}}
+
+	var steps []string
+	var gotErr error
+	c := &Client{maxRetries: 1, maxRetryDelay: time.Millisecond}
+	WithStepHook(func(step string, duration time.Duration, err error) {
+		if duration < time.Millisecond {
+			t.Errorf("step hook duration = %v, want at least the retry delay", duration)
+		}
+		steps = append(steps, step)
+		gotErr = err
+	})(c)
+
+	c.retry(context.Background(), "patch", func() error {
+		return throttled
+	})
+
+	// the hook is called once per step rather than per attempt
+	if len(steps) != 1 || steps[0] != "patch" || gotErr != throttled {
+		t.Errorf("step hook calls = %v with error %v, want [patch] with %v", steps, gotErr, throttled)
+	}
+}
+
+func TestRetryThrottledOnlyRetriesRetryAfter(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantAttempts int
+	}{
+		{"too many requests", &statusError{statusCode: http.StatusTooManyRequests, header: http.Header{"Retry-After": []string{"1"}}}, 2},
+		{"unavailable", &statusError{statusCode: http.StatusServiceUnavailable, header: http.Header{"Retry-After": []string{"1"}}}, 2},
+		{"unavailable without retry-after", &statusError{statusCode: http.StatusServiceUnavailable, header: http.Header{}}, 1},
+		{"gateway timeout", &statusError{statusCode: http.StatusGatewayTimeout, header: http.Header{"Retry-After": []string{"1"}}}, 1},
+		{"server error", &statusError{statusCode: http.StatusInternalServerError, header: http.Header{}}, 1},
+		{"not a response", errors.New("boom"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{maxRetries: 1, maxRetryDelay: time.Millisecond}
+
+			attempts := 0
+			err := c.retryThrottled(context.Background(), "send", func() error {
+				attempts++
+				return tt.err
+			})
+			if err != tt.err {
+				t.Fatalf("retryThrottled() error = %v, want %v", err, tt.err)
+			}
+
+			if attempts != tt.wantAttempts {
+				t.Fatalf("retryThrottled() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"forbidden", &statusError{statusCode: http.StatusForbidden, header: http.Header{}}, true},
+		{"throttled", &statusError{statusCode: http.StatusServiceUnavailable, header: http.Header{"Retry-After": []string{"1"}}}, true},
+		{"request timeout", &statusError{statusCode: http.StatusRequestTimeout, header: http.Header{}}, false},
+		{"server error", &statusError{statusCode: http.StatusInternalServerError, header: http.Header{}}, false},
+		{"unavailable", &statusError{statusCode: http.StatusServiceUnavailable, header: http.Header{}}, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"network", errors.New("connection reset by peer"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendRejected(tt.err); got != tt.want {
+				t.Errorf("sendRejected(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagDraft(t *testing.T) {
+	tagged := tagDraft([]byte("Subject: test\r\n\r\nbody"))
+
+	msg, err := mail.ReadMessage(bytes.NewReader(tagged))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got := msg.Header.Get(draftHeader); got != draftHeaderValue {
+		t.Errorf("%s header = %q, want %q", draftHeader, got, draftHeaderValue)
+	}
+	if got := msg.Header.Get("Subject"); got != "test" {
+		t.Errorf("Subject header = %q, want test", got)
+	}
+}
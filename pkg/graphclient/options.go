@@ -0,0 +1,52 @@
+package graphclient
+
+import "time"
+
+type ClientOption func(*Client)
+
+// WithMaxRetries sets how many times each Graph request is retried after a
+// throttling or transient server error
+func WithMaxRetries(retries int) ClientOption {
+	return func(c *Client) {
+		if retries >= 0 {
+			c.maxRetries = retries
+		}
+	}
+}
+
+// WithMaxRetryDelay caps the delay between retries, including any delay
+// requested by Graph via Retry-After
+func WithMaxRetryDelay(delay time.Duration) ClientOption {
+	return func(c *Client) {
+		if delay > 0 {
+			c.maxRetryDelay = delay
+		}
+	}
+}
+
+// WithRetryHook sets a function that is called before each retry with the
+// name of the step being retried, the error and the delay until the retry
+func WithRetryHook(hook func(step string, err error, delay time.Duration)) ClientOption {
+	return func(c *Client) {
+		c.onRetry = hook
+	}
+}
+
+// WithStepHook sets a function that is called after each step of a send, such
+// as "create", "patch" or "send", with how long the step took including any
+// retries and the error it returned
+func WithStepHook(hook func(step string, duration time.Duration, err error)) ClientOption {
+	return func(c *Client) {
+		c.onStep = hook
+	}
+}
+
+// WithSendTimeout sets a deadline for each call to SendMime, after which any
+// request in progress is cancelled
+func WithSendTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if timeout > 0 {
+			c.sendTimeout = timeout
+		}
+	}
+}
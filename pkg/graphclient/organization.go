@@ -0,0 +1,61 @@
+package graphclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	graphorganization "github.com/microsoftgraph/msgraph-sdk-go/organization"
+)
+
+// Ping makes a request to Graph to check that it is reachable and accepts the
+// credential, unlike Validate which may return a cached token. Graph only
+// denies access once it has accepted the token, so a 403 response, such as
+// when Organization.Read.All is not granted, is not an error.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Organization().Get(ctx, &graphorganization.OrganizationRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphorganization.OrganizationRequestBuilderGetQueryParameters{
+			Select: []string{"id"},
+		},
+	})
+	if err != nil && StatusCode(err) != http.StatusForbidden {
+		return fmt.Errorf("could not reach graph: %w", err)
+	}
+
+	return nil
+}
+
+// VerifiedDomains returns the verified domains of the tenant, in lower case.
+// This requires the Organization.Read.All application permission.
+func (c *Client) VerifiedDomains(ctx context.Context) ([]string, error) {
+	res, err := c.Organization().Get(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get organization: %w", err)
+	}
+
+	domains := make([]string, 0)
+	for _, org := range res.GetValue() {
+		for _, domain := range org.GetVerifiedDomains() {
+			if name := domain.GetName(); name != nil && *name != "" {
+				domains = append(domains, strings.ToLower(*name))
+			}
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("tenant has no verified domains")
+	}
+
+	return domains, nil
+}
+
+// CheckUser checks that userID, a user ID or user principal name, exists in
+// the tenant. This requires the User.Read.All application permission.
+func (c *Client) CheckUser(ctx context.Context, userID string) error {
+	if _, err := c.Users().ByUserId(userID).Get(ctx, nil); err != nil {
+		return fmt.Errorf("could not get user %q: %w", userID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package graphclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	nethttp "github.com/microsoft/kiota-http-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// noMiddlewareRetry disables the retry handler built in to the Graph request
+// adapter so that retries are controlled solely by the client retry budget.
+var noMiddlewareRetry = []abstractions.RequestOption{
+	&nethttp.RetryHandlerOptions{
+		ShouldRetry: func(time.Duration, int, *http.Request, *http.Response) bool {
+			return false
+		},
+	},
+}
+
+// statusError is returned for failed requests made outside of the Graph
+// request adapter, such as upload session chunks.
+type statusError struct {
+	statusCode int
+	header     http.Header
+	message    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("upload returned %d %s: %s", e.statusCode, http.StatusText(e.statusCode), e.message)
+}
+
+// StatusCode returns the HTTP status code of a failed Graph request, or 0 if
+// err did not come from a Graph response.
+func StatusCode(err error) int {
+	code, _ := responseStatus(err)
+	return code
+}
+
+// ErrorCode returns the Graph error code of a failed Graph request, such as
+// ErrorSendAsDenied, or "" if err did not include one.
+func ErrorCode(err error) string {
+	var odataErr *odataerrors.ODataError
+	if errors.As(err, &odataErr) {
+		if main := odataErr.GetErrorEscaped(); main != nil && main.GetCode() != nil {
+			return *main.GetCode()
+		}
+	}
+
+	return ""
+}
+
+// IsTransient reports whether err is a throttling or transient server error
+// that is worth retrying later.
+func IsTransient(err error) bool {
+	code, _ := responseStatus(err)
+
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// isThrottled reports whether err is a 429 or 503 response carrying a
+// Retry-After delay, with which Graph rejects a request without processing it.
+func isThrottled(err error) bool {
+	code, delay := responseStatus(err)
+	return (code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable) && delay > 0
+}
+
+// responseStatus extracts the status code and Retry-After delay from a failed
+// request
+func responseStatus(err error) (int, time.Duration) {
+	var apiErr abstractions.ApiErrorable
+	if errors.As(err, &apiErr) {
+		var retryAfter []string
+		if headers := apiErr.GetResponseHeaders(); headers != nil {
+			retryAfter = headers.Get("Retry-After")
+		}
+		return apiErr.GetStatusCode(), parseRetryAfter(retryAfter)
+	}
+
+	var sErr *statusError
+	if errors.As(err, &sErr) {
+		return sErr.statusCode, parseRetryAfter(sErr.header.Values("Retry-After"))
+	}
+
+	return 0, 0
+}
+
+func parseRetryAfter(values []string) time.Duration {
+	if len(values) == 0 || values[0] == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(values[0]); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(values[0]); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return 0
+}
+
+// retry runs fn until it succeeds, returns an error that is not transient or
+// the retry budget is exhausted. Retry-After is honoured when provided,
+// otherwise an exponential backoff is used.
+func (c *Client) retry(ctx context.Context, step string, fn func() error) error {
+	return c.retryWhen(ctx, step, IsTransient, fn)
+}
+
+// retryThrottled is retry for requests that are not idempotent, such as
+// creating or sending a draft. These are only retried when Graph throttled the
+// request, as any other failure may have happened after it took effect. A
+// draft is also looked up before it is sent again, in case the earlier attempt
+// was sent.
+func (c *Client) retryThrottled(ctx context.Context, step string, fn func() error) error {
+	return c.retryWhen(ctx, step, isThrottled, fn)
+}
+
+// retryWhen runs fn until it succeeds, returns an error that shouldRetry
+// rejects or the retry budget is exhausted.
+func (c *Client) retryWhen(ctx context.Context, step string, shouldRetry func(error) bool, fn func() error) (err error) {
+	if c.onStep != nil {
+		start := time.Now()
+		defer func() {
+			c.onStep(step, time.Since(start), err)
+		}()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !shouldRetry(err) || attempt >= c.maxRetries {
+			return err
+		}
+
+		_, delay := responseStatus(err)
+		if delay == 0 {
+			delay = time.Second << attempt
+		}
+		delay = min(delay, c.maxRetryDelay)
+
+		if c.onRetry != nil {
+			c.onRetry(step, err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
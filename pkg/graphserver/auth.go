@@ -0,0 +1,220 @@
+package graphserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const saslLogin = "LOGIN"
+
+// Unauthenticated relay modes
+const (
+	// RelaySources allows unauthenticated relaying from the allowed sources
+	RelaySources = "sources"
+	// RelayDisabled requires every client to authenticate
+	RelayDisabled = "disabled"
+)
+
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// authUser is an SMTP AUTH user loaded from the users file
+type authUser struct {
+	name    string
+	hash    string
+	senders []string
+}
+
+// loadUsers reads a users file where each line is in the form:
+//
+//	username:hash[:sender,sender...]
+//
+// The hash may be bcrypt (as produced by "htpasswd -nB") or an argon2id PHC
+// string. Users without senders may only send as their username, which must
+// then be an email address. Blank lines and lines starting with "#" are
+// ignored.
+func loadUsers(path string) (map[string]*authUser, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read users file: %w", err)
+	}
+
+	users := make(map[string]*authUser)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid users file entry on line %d", n)
+		}
+
+		if !strings.HasPrefix(fields[1], "$2") && !strings.HasPrefix(fields[1], "$argon2id$") {
+			return nil, fmt.Errorf("unsupported password hash for user %q on line %d", fields[0], n)
+		}
+
+		u := &authUser{
+			name: fields[0],
+			hash: fields[1],
+		}
+
+		if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+			senders, err := normalizeMailboxList([]string{fields[2]})
+			if err != nil {
+				return nil, fmt.Errorf("invalid senders for user %q on line %d: %w", fields[0], n, err)
+			}
+			u.senders = senders
+		} else {
+			sender, err := normalizeMailbox(u.name)
+			if err != nil {
+				return nil, fmt.Errorf("user %q on line %d must list the senders it may use, as the username is not an email address", u.name, n)
+			}
+			u.senders = []string{sender}
+		}
+
+		if _, exists := users[u.name]; exists {
+			return nil, fmt.Errorf("duplicate user %q on line %d", u.name, n)
+		}
+		users[u.name] = u
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read users file: %w", err)
+	}
+
+	return users, nil
+}
+
+func (u *authUser) verify(password string) bool {
+	if strings.HasPrefix(u.hash, "$argon2id$") {
+		return verifyArgon2id(u.hash, password)
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(u.hash), []byte(password)) == nil
+}
+
+// verifyArgon2id checks a password against a PHC formatted argon2id hash:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func verifyArgon2id(encoded, password string) bool {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, computed) == 1
+}
+
+// loginServer implements the server side of the obsolete but widely deployed
+// LOGIN SASL mechanism.
+type loginServer struct {
+	username     string
+	step         int
+	authenticate func(username, password string) error
+}
+
+func (s *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		s.step++
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		fallthrough
+	case 1:
+		s.step = 2
+		s.username = string(response)
+		return []byte("Password:"), false, nil
+	case 2:
+		s.step++
+		return nil, true, s.authenticate(s.username, string(response))
+	}
+
+	return nil, false, sasl.ErrUnexpectedClientResponse
+}
+
+// AuthMechanisms returns the SASL mechanisms offered when a users file is set.
+func (s *Session) AuthMechanisms() []string {
+	if s.users == nil {
+		return nil
+	}
+
+	return []string{sasl.Plain, saslLogin}
+}
+
+// Auth returns the SASL server for the requested mechanism.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.users == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+
+	if s.requireTLS && !s.tls {
+		s.fail(errors.New("TLS required"), true)
+		return nil, errTLSRequired
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				s.fail(fmt.Errorf("authorization identity %q does not match user %q", identity, username), true)
+				return smtp.ErrAuthFailed
+			}
+			return s.authenticate(username, password)
+		}), nil
+	case saslLogin:
+		return &loginServer{authenticate: s.authenticate}, nil
+	}
+
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+func (s *Session) authenticate(username, password string) error {
+	u, ok := s.users[username]
+	if !ok || !u.verify(password) {
+		s.fail(fmt.Errorf("authentication failed for user %q", username), true)
+		return smtp.ErrAuthFailed
+	}
+
+	s.user = u
+	return nil
+}
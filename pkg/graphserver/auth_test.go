@@ -0,0 +1,123 @@
+package graphserver
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadUsersVerifiesPasswords(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("printer-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() error = %v", err)
+	}
+
+	salt := []byte("0123456789abcdef")
+	argonHash := "$argon2id$v=19$m=1024,t=1,p=1$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("scanner-secret"), salt, 1, 1024, 1, 32))
+
+	path := filepath.Join(t.TempDir(), "users")
+	content := strings.Join([]string{
+		"# printers",
+		"printer:" + string(bcryptHash) + ":Printer1@Example.com,printer2@example.com",
+		"",
+		"Scanner@Example.com:" + argonHash,
+	}, "\n")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	users, err := loadUsers(path)
+	if err != nil {
+		t.Fatalf("loadUsers() error = %v", err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"printer", "printer-secret", true},
+		{"printer", "wrong", false},
+		{"Scanner@Example.com", "scanner-secret", true},
+		{"Scanner@Example.com", "printer-secret", false},
+	}
+	for _, tt := range tests {
+		if got := users[tt.user].verify(tt.password); got != tt.want {
+			t.Errorf("verify(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	if got := strings.Join(users["printer"].senders, ","); got != "printer1@example.com,printer2@example.com" {
+		t.Fatalf("printer senders = %q, want normalised list", got)
+	}
+
+	// users without senders may only send as themselves
+	if got := strings.Join(users["Scanner@Example.com"].senders, ","); got != "scanner@example.com" {
+		t.Fatalf("scanner senders = %q, want username", got)
+	}
+
+	if err := os.WriteFile(path, []byte("scanner:"+argonHash), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if _, err := loadUsers(path); err == nil {
+		t.Fatalf("loadUsers() with a user without senders error = nil, want error")
+	}
+}
+
+func TestLoginServer(t *testing.T) {
+	var gotUser, gotPassword string
+	s := &loginServer{authenticate: func(username, password string) error {
+		gotUser, gotPassword = username, password
+		return nil
+	}}
+
+	if challenge, done, err := s.Next(nil); string(challenge) != "Username:" || done || err != nil {
+		t.Fatalf("Next(nil) = %q, %v, %v", challenge, done, err)
+	}
+	if challenge, done, err := s.Next([]byte("printer")); string(challenge) != "Password:" || done || err != nil {
+		t.Fatalf("Next(username) = %q, %v, %v", challenge, done, err)
+	}
+	if _, done, err := s.Next([]byte("secret")); !done || err != nil {
+		t.Fatalf("Next(password) = %v, %v", done, err)
+	}
+
+	if gotUser != "printer" || gotPassword != "secret" {
+		t.Fatalf("authenticated %q/%q, want printer/secret", gotUser, gotPassword)
+	}
+}
+
+func TestPlainAuthIdentity(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword() error = %v", err)
+	}
+
+	s := &Session{
+		users:      map[string]*authUser{"printer": {name: "printer", hash: string(hash)}},
+		sendDenied: prometheus.NewCounter(prometheus.CounterOpts{Name: "denied"}),
+	}
+
+	server, err := s.Auth(sasl.Plain)
+	if err != nil {
+		t.Fatalf("Auth() error = %v", err)
+	}
+
+	// a mismatched identity is an authentication failure, without the reason
+	// being sent to the client
+	if _, _, err := server.Next([]byte("scanner\x00printer\x00secret")); err != smtp.ErrAuthFailed {
+		t.Errorf("Next() with another identity error = %v, want %v", err, smtp.ErrAuthFailed)
+	}
+	if s.user != nil {
+		t.Errorf("user authenticated with another identity")
+	}
+}
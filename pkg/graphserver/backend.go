@@ -1,24 +1,65 @@
 package graphserver
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"net"
 	"net/mail"
+	"net/netip"
+	"path"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
 )
 
 type Backend struct {
-	client         *graphclient.Client
-	logger         Logger
-	allowedSenders []string
-	allowedSources []string
-	sendUser       string
+	tenantConfig    []Tenant
+	tenants         *tenantSet
+	fallback        Sender
+	router          *router
+	baseCtx         context.Context
+	drainer         *drainer
+	logger          Logger
+	allowedSenders  []string
+	rewriteRules    []RewriteRule
+	rewriter        *rewriter
+	allowedSources  []string
+	deniedSources   []string
+	recipientConfig []RecipientPolicy
+	recipients      []*recipientPolicy
+	sources         *sourcePolicy
+	listener        *listener
+	requireTLS      bool
+	tlsExempt       []string
+	tlsExemptions   []netip.Prefix
+	sendUser        string
+	sendUserRoutes  []SendUserRoute
+	spool           *spool.Spool
+	usersFile       string
+	users           map[string]*authUser
+	certConfig      []CertIdentity
+	certIdentities  []certIdentity
+	relay           string
+	envelopeMode    string
+	graphRetries    int
+	graphTimeout    time.Duration
+	queueTimeout    time.Duration
+	readTimeout     time.Duration
+	maxSends        int
+	maxUserSends    int
+	rateLimits      map[string]string
+	limiters        map[string]*limiter
+	domain          string
+	bounce          bool
+	bounceSender    string
+	noBounceSenders []string
 
 	reg prometheus.Registerer
 
@@ -26,37 +67,68 @@ type Backend struct {
 	emailTotal prometheus.Counter
 	sendErrors prometheus.Counter
 	sendDenied prometheus.Counter
+	retries    *prometheus.CounterVec
+	stepTime   *prometheus.HistogramVec
+	rejected   *prometheus.CounterVec
+	limited    *prometheus.CounterVec
+	bounces    prometheus.Counter
+	rcptDenied *prometheus.CounterVec
+	tlsTotal   *prometheus.CounterVec
+	tenantSent *prometheus.CounterVec
+	tenantErrs *prometheus.CounterVec
 }
 
-// NewGraphBackend sets up a new server
-func NewGraphBackend(clientId, tenantId, secret string, opts ...BackendOption) (*Backend, error) {
-	return newbackend(clientId, tenantId, secret, opts...)
+// NewGraphBackend sets up a new server using the provided Graph credential
+// option, such as graphclient.WithClientSecret, as the default tenant. The
+// credential may be nil if tenants are set with WithTenants, in which case
+// messages that match no tenant are rejected.
+func NewGraphBackend(cred graphclient.ClientOption, opts ...BackendOption) (*Backend, error) {
+	return newbackend(cred, nil, opts...)
 }
 
-func newbackend(clientId, tenantId, secret string, opts ...BackendOption) (*Backend, error) {
+// NewBackend sets up a new server delivering with sender, such as a
+// relayclient.Client, as the default tenant instead of Graph
+func NewBackend(sender Sender, opts ...BackendOption) (*Backend, error) {
+	if sender == nil {
+		return nil, fmt.Errorf("no sender was provided")
+	}
+
+	return newbackend(nil, sender, opts...)
+}
+
+func newbackend(cred graphclient.ClientOption, sender Sender, opts ...BackendOption) (*Backend, error) {
 	b := new(Backend)
+	b.graphRetries = 3
+	b.bounce = true
+	b.noBounceSenders = slices.Clone(DefaultNoBounceSenders)
 
 	// apply options
 	for _, o := range opts {
 		o(b)
 	}
 
-	// create graph client
-	client, err := graphclient.NewClient(tenantId, clientId, secret)
-	if err != nil {
-		return nil, fmt.Errorf("could not create client: %w", err)
-	}
-
-	b.client = client
-
 	// set defaults
 	if b.allowedSenders == nil {
 		b.allowedSenders = make([]string, 0)
 	}
 
-	if b.allowedSources == nil {
-		b.allowedSources = make([]string, 0)
+	rewriter, err := newRewriter(b.rewriteRules)
+	if err != nil {
+		return nil, err
+	}
+	b.rewriter = rewriter
+
+	sources, err := newSourcePolicy(b.allowedSources, b.deniedSources)
+	if err != nil {
+		return nil, err
+	}
+	b.sources = sources
+
+	recipients, err := newRecipientPolicies(b.recipientConfig)
+	if err != nil {
+		return nil, err
 	}
+	b.recipients = recipients
 
 	normalizedSenders, err := normalizeMailboxList(b.allowedSenders)
 	if err != nil {
@@ -64,6 +136,46 @@ func newbackend(clientId, tenantId, secret string, opts ...BackendOption) (*Back
 	}
 	b.allowedSenders = normalizedSenders
 
+	switch b.relay {
+	case "":
+		b.relay = RelaySources
+	case RelaySources, RelayDisabled:
+	default:
+		return nil, fmt.Errorf("invalid unauthenticated relay mode %q", b.relay)
+	}
+
+	switch b.envelopeMode {
+	case "":
+		b.envelopeMode = EnvelopeOverride
+	case EnvelopeOverride, EnvelopePreserve:
+	default:
+		return nil, fmt.Errorf("invalid envelope mode %q", b.envelopeMode)
+	}
+
+	tlsExemptions, err := parsePrefixes(b.tlsExempt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS exemptions: %w", err)
+	}
+	b.tlsExemptions = tlsExemptions
+
+	certIdentities, err := newCertIdentities(b.certConfig)
+	if err != nil {
+		return nil, err
+	}
+	b.certIdentities = certIdentities
+
+	b.listener = &listener{sources: b.sources, relay: b.relay, requireTLS: b.requireTLS}
+
+	if b.usersFile != "" {
+		users, err := loadUsers(b.usersFile)
+		if err != nil {
+			return nil, err
+		}
+		b.users = users
+	} else if b.relay == RelayDisabled {
+		return nil, fmt.Errorf("unauthenticated relay cannot be disabled without a users file")
+	}
+
 	if b.sendUser != "" {
 		normalized, err := normalizeMailbox(b.sendUser)
 		if err != nil {
@@ -72,6 +184,57 @@ func newbackend(clientId, tenantId, secret string, opts ...BackendOption) (*Back
 		b.sendUser = normalized
 	}
 
+	if b.domain == "" {
+		b.domain = "localhost"
+	}
+
+	if b.bounceSender != "" {
+		normalized, err := normalizeMailbox(b.bounceSender)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bounce sender %q: %w", b.bounceSender, err)
+		}
+		b.bounceSender = normalized
+	}
+
+	for i, pattern := range b.noBounceSenders {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid no bounce sender %q: %w", pattern, err)
+		}
+		b.noBounceSenders[i] = pattern
+	}
+
+	routes, err := newSendUserRoutes(b.sendUserRoutes)
+	if err != nil {
+		return nil, err
+	}
+	b.sendUserRoutes = routes
+
+	// bounces are sent from the Graph send user unless a bounce sender is set,
+	// so every send user must then be a mailbox
+	if b.bounce && b.bounceSender == "" {
+		for i, route := range b.sendUserRoutes {
+			if _, err := normalizeMailbox(route.GraphUser); err != nil {
+				return nil, fmt.Errorf("a bounce sender must be set, as the graph user %q of send user route %d is not a mailbox", route.GraphUser, i+1)
+			}
+		}
+	}
+
+	tenants, err := newTenantSet(cred, sender, b.tenantConfig)
+	if err != nil {
+		return nil, err
+	}
+	b.tenants = tenants
+
+	b.limiters = make(map[string]*limiter)
+	for _, name := range []string{LimitGlobal, LimitSource, LimitSender} {
+		rate, err := ParseRate(b.rateLimits[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rate limit: %w", name, err)
+		}
+		b.limiters[name] = newLimiter(name, rate)
+	}
+
 	// set up metrics
 	b.emailTotal = promauto.With(b.reg).NewCounter(
 		prometheus.CounterOpts{
@@ -91,19 +254,199 @@ func newbackend(clientId, tenantId, secret string, opts ...BackendOption) (*Back
 			Help: "Total number of emails denied",
 		},
 	)
+	b.retries = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_graph_retries_total",
+			Help: "Total number of Graph requests retried after throttling or transient errors",
+		},
+		[]string{"tenant", "step"},
+	)
+	b.stepTime = promauto.With(b.reg).NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "office365_smtp_proxy_graph_step_duration_seconds",
+			Help:    "Time taken by each step of a Graph send, including retries",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		},
+		[]string{"tenant", "step"},
+	)
+	b.rejected = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_source_rejected_total",
+			Help: "Total number of connections from sources that were not allowed to relay",
+		},
+		[]string{"reason"},
+	)
+	b.limited = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_rate_limited_total",
+			Help: "Total number of messages deferred by rate limits",
+		},
+		[]string{"limit"},
+	)
+	b.rcptDenied = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_recipient_denied_total",
+			Help: "Total number of recipients refused by recipient policies",
+		},
+		[]string{"reason"},
+	)
+	b.bounces = promauto.With(b.reg).NewCounter(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_bounces_total",
+			Help: "Total number of delivery status notifications sent for failed messages",
+		},
+	)
+
+	b.tlsTotal = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_tls_messages_total",
+			Help: "Total number of messages by negotiated TLS version and cipher suite",
+		},
+		[]string{"version", "cipher"},
+	)
+	b.tenantSent = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_tenant_sent_total",
+			Help: "Total number of messages sent through Graph by tenant",
+		},
+		[]string{"tenant"},
+	)
+	b.tenantErrs = promauto.With(b.reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "office365_smtp_proxy_tenant_errors_total",
+			Help: "Total number of Graph send errors by tenant",
+		},
+		[]string{"tenant"},
+	)
+
+	if b.baseCtx == nil {
+		b.baseCtx = context.Background()
+	}
+	b.drainer = newDrainer(b.baseCtx)
+
+	pool := newSendPool(b.maxSends, b.maxUserSends)
+	if pool != nil {
+		pool.timeout = b.queueTimeout
+		if pool.timeout == 0 {
+			pool.timeout = b.graphTimeout
+		}
+		pool.wait = promauto.With(b.reg).NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "office365_smtp_proxy_send_queue_wait_seconds",
+				Help:    "Time messages waited for a free send slot",
+				Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+			},
+		)
+		pool.inflight = promauto.With(b.reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "office365_smtp_proxy_sends_in_flight",
+				Help: "Number of messages currently being sent",
+			},
+		)
+	}
+
+	b.router = &router{
+		fallback: b.fallback,
+		pool:     pool,
+		delivered: promauto.With(b.reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "office365_smtp_proxy_route_delivered_total",
+				Help: "Total number of messages delivered by route",
+			},
+			[]string{"route"},
+		),
+		errors: promauto.With(b.reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "office365_smtp_proxy_route_errors_total",
+				Help: "Total number of delivery errors by route",
+			},
+			[]string{"route"},
+		),
+	}
+
+	// create a graph client for each tenant without a sender
+	for _, t := range b.tenants.tenants {
+		t.sender = t.Sender
+		if t.sender == nil {
+			client, err := graphclient.NewClient(t.Credential,
+				graphclient.WithMaxRetries(b.graphRetries),
+				graphclient.WithRetryHook(b.retryHook(t.Name)),
+				graphclient.WithStepHook(b.stepHook(t.Name)),
+				graphclient.WithSendTimeout(b.graphTimeout),
+			)
+			if err != nil {
+				return nil, fmt.Errorf("could not create client for tenant %q: %w", t.Name, err)
+			}
+			t.sender = client
+		}
+
+		t.sent = b.tenantSent.WithLabelValues(t.Name)
+		t.errors = b.tenantErrs.WithLabelValues(t.Name)
+	}
+
+	// internal only recipient policies allow the verified domains of the
+	// tenant a message is sent with
+	if needsVerifiedDomains(b.recipientConfig) {
+		ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+		defer cancel()
+
+		listed := false
+		for _, t := range b.tenants.tenants {
+			lister, ok := t.sender.(domainLister)
+			if !ok {
+				continue
+			}
+			verified, err := lister.VerifiedDomains(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("could not get verified domains of tenant %q for internal only recipients: %w", t.Name, err)
+			}
+			t.domains = verified
+			listed = true
+		}
+		if !listed {
+			return nil, fmt.Errorf("internal only recipients require a Graph tenant")
+		}
+	}
 
 	return b, nil
 }
 
 // NewSession is called after client greeting (EHLO, HELO).
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return b.newSession(c, b.listener)
+}
+
+func (b *Backend) newSession(c *smtp.Conn, l *listener) (smtp.Session, error) {
+	remote := c.Conn().RemoteAddr().String()
+	state, isTLS := c.TLSConnectionState()
+	tlsVersion, tlsCipher := "none", "none"
+	var user *authUser
+	if isTLS {
+		tlsVersion, tlsCipher = tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+
+		// a verified client certificate identifies the client in place of
+		// SMTP AUTH
+		if user = certUser(b.certIdentities, state); user != nil && b.logger != nil {
+			b.logger.Info("client certificate identified", "remote", remote, "user", user.name, "listener", l.name)
+		}
+	}
+
 	// Check if IP is allowed
-	if len(b.allowedSources) > 0 {
-		if addr, _, err := net.SplitHostPort(c.Conn().RemoteAddr().String()); err == nil {
-			if _, found := slices.BinarySearch(b.allowedSources, addr); !found {
-				b.sendDenied.Inc()
-				return nil, fmt.Errorf("source not allowed")
+	trusted, reason := l.sources.checkRelay(remote, b.users != nil)
+	if !trusted {
+		b.rejected.WithLabelValues(reason).Inc()
+
+		// untrusted sources may still connect to authenticate unless denied
+		if reason == sourceDenied || (b.users == nil && user == nil) {
+			if b.logger != nil {
+				b.logger.Warn("source rejected", "remote", remote, "reason", reason, "listener", l.name)
 			}
+			b.sendDenied.Inc()
+			return nil, fmt.Errorf("source not allowed")
+		}
+
+		if user == nil && b.logger != nil {
+			b.logger.Info("source not trusted, authentication required", "remote", remote, "reason", reason, "listener", l.name)
 		}
 	}
 
@@ -112,18 +455,210 @@ func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 
 	// return new session
 	return &Session{
-		client:         b.client,
+		tenants:        b.tenants,
+		router:         b.router,
+		drainer:        b.drainer,
+		conn:           c.Conn(),
+		readTimeout:    b.readTimeout,
 		logger:         b.logger,
 		allowedSenders: b.allowedSenders,
 		sendUser:       b.sendUser,
+		sendUserRoutes: b.sendUserRoutes,
+		spool:          b.spool,
+		users:          b.users,
+		user:           user,
+		relay:          l.relay,
+		envelopeMode:   b.envelopeMode,
+		trusted:        trusted,
+		listener:       l.name,
+		requireTLS:     b.tlsRequired(l, remote),
+		tls:            isTLS,
+		tlsVersion:     tlsVersion,
+		tlsCipher:      tlsCipher,
+		rewriter:       b.rewriter,
+		recipientRules: b.recipients,
+		source:         sourceKey(remote),
+		globalLimit:    b.limiters[LimitGlobal],
+		sourceLimit:    b.limiters[LimitSource],
+		senderLimit:    b.limiters[LimitSender],
 		helo:           c.Hostname(),
-		remote:         c.Conn().RemoteAddr().String(),
+		remote:         remote,
 		errors:         make([]error, 0),
 		sendErrors:     b.sendErrors,
 		sendDenied:     b.sendDenied,
+		rateLimited:    b.limited,
+		rcptDenied:     b.rcptDenied,
+		tlsTotal:       b.tlsTotal,
 	}, nil
 }
 
+// tlsRequired returns whether sessions from remote on l must use TLS, where
+// trusted devices that cannot use TLS may be exempted
+func (b *Backend) tlsRequired(l *listener, remote string) bool {
+	if !l.requireTLS {
+		return false
+	}
+
+	addr, err := parseRemoteAddr(remote)
+	return err != nil || !matchPrefixes(b.tlsExemptions, addr)
+}
+
+// Deliver sends a spooled message through Graph and is intended to be used as
+// the spool.DeliverFunc for the spool passed to WithSpool. Deliveries are
+// waited for by Drain, and cancelled if its grace period expires.
+func (b *Backend) Deliver(ctx context.Context, msg *spool.Message) error {
+	t := b.tenants.get(msg.Tenant)
+	if t == nil {
+		b.sendErrors.Inc()
+		return spool.Permanent(fmt.Errorf("unknown tenant %q", msg.Tenant))
+	}
+
+	// spooled deliveries are drained on shutdown like SMTP transactions
+	if !b.drainer.begin() {
+		return errShuttingDown
+	}
+	defer b.drainer.end()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(b.drainer.context(), cancel)()
+
+	route, err := b.router.send(ctx, t, msg.GraphUser, msg.From, msg.Recipients, msg.MIME)
+	msg.Route = route
+	if err != nil {
+		b.sendErrors.Inc()
+		if permanent(err) {
+			return spool.Permanent(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Drain refuses new transactions and waits for messages being received or
+// sent to finish until ctx is done, after which sends in progress are
+// cancelled. It returns how many transactions finished and how many were
+// aborted, and should be called before the SMTP servers are closed.
+func (b *Backend) Drain(ctx context.Context) (drained, aborted int) {
+	return b.drainer.drain(ctx)
+}
+
+// ValidateCredentials checks that a Graph token can be obtained for each
+// tenant, returning the errors of any that failed. Tenants using senders that
+// cannot be validated are skipped.
+func (b *Backend) ValidateCredentials(ctx context.Context) error {
+	errs := make([]error, 0)
+	for _, t := range b.tenants.tenants {
+		v, ok := t.sender.(validator)
+		if !ok {
+			continue
+		}
+
+		if err := v.Validate(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", t.Name, err))
+			continue
+		}
+
+		if b.logger != nil {
+			b.logger.Info("graph credential validated", "tenant", t.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckGraph makes a request to Graph for each tenant, for use by readiness
+// probes. Unlike ValidateCredentials this does not rely on a cached token, so
+// it fails once Graph stops accepting requests. Tenants using senders that
+// cannot make a request fall back to validating their credential.
+func (b *Backend) CheckGraph(ctx context.Context) error {
+	errs := make([]error, 0)
+	for _, t := range b.tenants.tenants {
+		var err error
+		switch s := t.sender.(type) {
+		case pinger:
+			err = s.Ping(ctx)
+		case validator:
+			err = s.Validate(ctx)
+		default:
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", t.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateSendUsers checks that the send user and the Graph users of send
+// user routes exist in at least one tenant, so that a mistyped user is found
+// before any message is sent. Users are not checked if no tenant can check
+// them.
+func (b *Backend) ValidateSendUsers(ctx context.Context) error {
+	checkers := make([]userChecker, 0, len(b.tenants.tenants))
+	for _, t := range b.tenants.tenants {
+		if c, ok := t.sender.(userChecker); ok {
+			checkers = append(checkers, c)
+		}
+	}
+	if len(checkers) == 0 {
+		return nil
+	}
+
+	users := make([]string, 0, len(b.sendUserRoutes)+1)
+	if b.sendUser != "" {
+		users = append(users, b.sendUser)
+	}
+	for _, route := range b.sendUserRoutes {
+		if !slices.Contains(users, route.GraphUser) {
+			users = append(users, route.GraphUser)
+		}
+	}
+
+	errs := make([]error, 0)
+	for _, user := range users {
+		var err error
+		for _, c := range checkers {
+			if err = c.CheckUser(ctx, user); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("send user %q: %w", user, err))
+			continue
+		}
+
+		if b.logger != nil {
+			b.logger.Info("send user verified", "user", user)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// retryHook returns the graph client retry hook for tenant
+func (b *Backend) retryHook(tenant string) func(step string, err error, delay time.Duration) {
+	return func(step string, err error, delay time.Duration) {
+		b.retries.WithLabelValues(tenant, step).Inc()
+		if b.logger != nil {
+			b.logger.Warn("retrying graph request", "tenant", tenant, "step", step, "error", err, "status", graphclient.StatusCode(err), "delay", delay)
+		}
+	}
+}
+
+// stepHook returns the graph client step hook for tenant
+func (b *Backend) stepHook(tenant string) func(step string, duration time.Duration, err error) {
+	return func(step string, duration time.Duration, err error) {
+		b.stepTime.WithLabelValues(tenant, step).Observe(duration.Seconds())
+	}
+}
+
+// startupTimeout bounds Graph requests made while setting up the backend
+const startupTimeout = 30 * time.Second
+
 type BackendOption func(*Backend)
 
 func WithAllowedSenders(senders []string) BackendOption {
@@ -136,21 +671,219 @@ func WithAllowedSenders(senders []string) BackendOption {
 	}
 }
 
+// WithRewriteRules sets rules that rewrite the envelope sender before it is
+// checked against the allowed senders. The first matching rule is used.
+func WithRewriteRules(rules []RewriteRule) BackendOption {
+	return func(b *Backend) {
+		b.rewriteRules = append([]RewriteRule(nil), rules...)
+	}
+}
+
 func WithSendUser(sendUser string) BackendOption {
 	return func(b *Backend) {
 		b.sendUser = strings.TrimSpace(sendUser)
 	}
 }
 
+// WithSendUserRoutes sets routes that choose the Graph user to send as by
+// envelope sender. The first matching route is used, falling back to the send
+// user set by WithSendUser and then the envelope sender.
+func WithSendUserRoutes(routes []SendUserRoute) BackendOption {
+	return func(b *Backend) {
+		b.sendUserRoutes = append([]SendUserRoute(nil), routes...)
+	}
+}
+
+// WithAllowedSources sets the sources that may relay without authenticating,
+// as CIDR blocks, IP addresses or hostnames resolved at startup
 func WithAllowedSources(sources []string) BackendOption {
 	return func(b *Backend) {
-		if sources == nil {
-			b.allowedSources = make([]string, 0)
-		} else {
-			// make sure it's sorted
-			slices.Sort(sources)
-			b.allowedSources = sources
-		}
+		b.allowedSources = append([]string(nil), sources...)
+	}
+}
+
+// WithDeniedSources sets sources that are always rejected, even if they are
+// within the allowed sources or would authenticate
+func WithDeniedSources(sources []string) BackendOption {
+	return func(b *Backend) {
+		b.deniedSources = append([]string(nil), sources...)
+	}
+}
+
+// WithRecipientPolicies restricts the recipients clients may relay to. The
+// first policy matching the envelope sender and source is used, and if none
+// match any recipient is allowed.
+func WithRecipientPolicies(policies []RecipientPolicy) BackendOption {
+	return func(b *Backend) {
+		b.recipientConfig = append([]RecipientPolicy(nil), policies...)
+	}
+}
+
+// WithTenants sets named Graph credentials used instead of the default
+// credential for messages from matching SMTP AUTH users or sender domains
+func WithTenants(tenants []Tenant) BackendOption {
+	return func(b *Backend) {
+		b.tenantConfig = append([]Tenant(nil), tenants...)
+	}
+}
+
+// WithRequireTLS refuses AUTH and MAIL on connections that have not been
+// encrypted with STARTTLS or implicit TLS
+func WithRequireTLS(required bool) BackendOption {
+	return func(b *Backend) {
+		b.requireTLS = required
+	}
+}
+
+// WithTLSExemptions sets sources, as CIDR blocks, IP addresses or hostnames,
+// that are not required to use TLS
+func WithTLSExemptions(sources []string) BackendOption {
+	return func(b *Backend) {
+		b.tlsExempt = append([]string(nil), sources...)
+	}
+}
+
+// WithCertIdentities maps verified TLS client certificates to identities that
+// are treated as authenticated. The TLS configuration of the SMTP server must
+// request and verify client certificates.
+func WithCertIdentities(identities []CertIdentity) BackendOption {
+	return func(b *Backend) {
+		b.certConfig = append([]CertIdentity(nil), identities...)
+	}
+}
+
+// WithFallback sets a secondary sender, such as a relayclient.Client for a
+// smarthost, that messages are delivered with when the primary sender fails
+// with a transient or authentication error
+func WithFallback(sender Sender) BackendOption {
+	return func(b *Backend) {
+		b.fallback = sender
+	}
+}
+
+// WithBaseContext sets the context that messages are sent with, so sends in
+// progress are cancelled when it is done. This defaults to
+// context.Background.
+func WithBaseContext(ctx context.Context) BackendOption {
+	return func(b *Backend) {
+		b.baseCtx = ctx
+	}
+}
+
+// WithSpool enables asynchronous delivery, where accepted messages are written
+// to the spool and delivered in the background by the spool worker
+func WithSpool(sp *spool.Spool) BackendOption {
+	return func(b *Backend) {
+		b.spool = sp
+	}
+}
+
+// WithUsersFile enables SMTP AUTH using the users loaded from path
+func WithUsersFile(path string) BackendOption {
+	return func(b *Backend) {
+		b.usersFile = strings.TrimSpace(path)
+	}
+}
+
+// WithUnauthenticatedRelay sets whether clients that have not authenticated
+// may relay from the allowed sources (RelaySources) or not at all
+// (RelayDisabled). This only applies when a users file is set.
+func WithUnauthenticatedRelay(mode string) BackendOption {
+	return func(b *Backend) {
+		b.relay = strings.ToLower(strings.TrimSpace(mode))
+	}
+}
+
+// WithEnvelopeMode sets how the SMTP envelope is applied to the MIME headers,
+// either EnvelopeOverride (the default) or EnvelopePreserve
+func WithEnvelopeMode(mode string) BackendOption {
+	return func(b *Backend) {
+		b.envelopeMode = strings.ToLower(strings.TrimSpace(mode))
+	}
+}
+
+// WithRateLimits sets token bucket rate limits keyed by limit type (LimitGlobal,
+// LimitSource or LimitSender) in the form accepted by ParseRate. Exceeding a limit
+// defers the message with a 451 temporary failure.
+func WithRateLimits(limits map[string]string) BackendOption {
+	return func(b *Backend) {
+		b.rateLimits = limits
+	}
+}
+
+// WithDomain sets the hostname the server identifies as, which is used as the
+// reporting MTA in bounces
+func WithDomain(domain string) BackendOption {
+	return func(b *Backend) {
+		b.domain = strings.TrimSpace(domain)
+	}
+}
+
+// WithBounces sets whether delivery status notifications are sent to the
+// envelope sender of spooled messages that fail permanently (the default)
+func WithBounces(enabled bool) BackendOption {
+	return func(b *Backend) {
+		b.bounce = enabled
+	}
+}
+
+// WithBounceSender sets the address bounces are sent from, which defaults to
+// the Graph user the failed message was sent as
+func WithBounceSender(sender string) BackendOption {
+	return func(b *Backend) {
+		b.bounceSender = strings.TrimSpace(sender)
+	}
+}
+
+// WithNoBounceSenders sets glob patterns, such as "noreply@*", matching
+// envelope senders that are never sent bounces. This replaces
+// DefaultNoBounceSenders.
+func WithNoBounceSenders(patterns []string) BackendOption {
+	return func(b *Backend) {
+		b.noBounceSenders = append([]string(nil), patterns...)
+	}
+}
+
+// WithGraphRetries sets how many times each Graph request is retried after
+// throttling or a transient server error
+func WithGraphRetries(retries int) BackendOption {
+	return func(b *Backend) {
+		b.graphRetries = retries
+	}
+}
+
+// WithConcurrencyLimits bounds how many messages are sent at once in total and
+// as each Graph user, with messages over either limit waiting for a free
+// slot. A limit of zero or less is unlimited, which is the default.
+func WithConcurrencyLimits(global, perUser int) BackendOption {
+	return func(b *Backend) {
+		b.maxSends = global
+		b.maxUserSends = perUser
+	}
+}
+
+// WithSendQueueTimeout sets how long a message may wait for a free send slot
+// before it is deferred, which defaults to the Graph timeout
+func WithSendQueueTimeout(timeout time.Duration) BackendOption {
+	return func(b *Backend) {
+		b.queueTimeout = timeout
+	}
+}
+
+// WithGraphTimeout sets a deadline for sending each message through Graph,
+// including retries and attachment uploads
+func WithGraphTimeout(timeout time.Duration) BackendOption {
+	return func(b *Backend) {
+		b.graphTimeout = timeout
+	}
+}
+
+// WithReadTimeout sets how long to wait for each read of message data from the
+// client during DATA. The time waiting for commands is instead set by the
+// ReadTimeout of the smtp.Server.
+func WithReadTimeout(timeout time.Duration) BackendOption {
+	return func(b *Backend) {
+		b.readTimeout = timeout
 	}
 }
 
@@ -0,0 +1,95 @@
+package graphserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CertIdentity maps verified TLS client certificates to an identity that may
+// relay without SMTP AUTH or being within the allowed sources.
+//
+// Match holds exact values or wildcard patterns such as "*.servers.example.com"
+// that are compared to the subject common name and the DNS, email and URI
+// subject alternative names of the certificate. Senders optionally restricts the
+// envelope senders the identity may use, as the third field of the users file
+// does for SMTP AUTH users.
+type CertIdentity struct {
+	Name    string   `mapstructure:"name"`
+	Match   []string `mapstructure:"match"`
+	Senders []string `mapstructure:"senders"`
+}
+
+type certIdentity struct {
+	match []string
+	user  *authUser
+}
+
+func newCertIdentities(identities []CertIdentity) ([]certIdentity, error) {
+	compiled := make([]certIdentity, 0, len(identities))
+	for i, identity := range identities {
+		name := strings.TrimSpace(identity.Name)
+		match := normalizePatterns(identity.Match)
+		if name == "" || len(match) == 0 {
+			return nil, fmt.Errorf("client certificate identity %d must have a name and match", i+1)
+		}
+
+		for _, pattern := range match {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q for client certificate identity %q: %w", pattern, name, err)
+			}
+		}
+
+		senders, err := normalizeMailboxList(identity.Senders)
+		if err != nil {
+			return nil, fmt.Errorf("invalid senders for client certificate identity %q: %w", name, err)
+		}
+
+		compiled = append(compiled, certIdentity{
+			match: match,
+			user:  &authUser{name: name, senders: senders},
+		})
+	}
+
+	return compiled, nil
+}
+
+// certUser returns the user of the first identity matching the verified client
+// certificate of state, or nil if there is none
+func certUser(identities []certIdentity, state tls.ConnectionState) *authUser {
+	if len(identities) == 0 || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	names := certNames(state.PeerCertificates[0])
+	for _, identity := range identities {
+		for _, name := range names {
+			if matchPatterns(identity.match, name) {
+				return identity.user
+			}
+		}
+	}
+
+	return nil
+}
+
+// certNames returns the lower case names a certificate may be matched by
+func certNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs))
+	if cert.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(cert.Subject.CommonName))
+	}
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, strings.ToLower(email))
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, strings.ToLower(uri.String()))
+	}
+
+	return names
+}
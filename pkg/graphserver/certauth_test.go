@@ -0,0 +1,60 @@
+package graphserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestCertUser(t *testing.T) {
+	identities, err := newCertIdentities([]CertIdentity{
+		{Name: "servers", Match: []string{"*.Servers.example.com"}, Senders: []string{"alerts@example.com"}},
+		{Name: "spiffe", Match: []string{"spiffe://example.com/mail/*"}},
+	})
+	if err != nil {
+		t.Fatalf("newCertIdentities() error = %v", err)
+	}
+
+	spiffe, _ := url.Parse("spiffe://example.com/mail/relay")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "web01.servers.example.com"}}, "servers"},
+		{"dns san", &x509.Certificate{DNSNames: []string{"db01.servers.example.com"}}, "servers"},
+		{"uri san", &x509.Certificate{URIs: []*url.URL{spiffe}}, "spiffe"},
+		{"no match", &x509.Certificate{Subject: pkix.Name{CommonName: "laptop.example.com"}}, ""},
+	}
+
+	for _, tt := range tests {
+		state := tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{tt.cert},
+			VerifiedChains:   [][]*x509.Certificate{{tt.cert}},
+		}
+
+		got := ""
+		if user := certUser(identities, state); user != nil {
+			got = user.name
+		}
+		if got != tt.want {
+			t.Errorf("%s: certUser() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// certificates that were not verified are ignored
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "web01.servers.example.com"}}
+	if user := certUser(identities, tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); user != nil {
+		t.Errorf("certUser() without verified chains = %q, want nil", user.name)
+	}
+
+	if got := identities[0].user.senders; len(got) != 1 || got[0] != "alerts@example.com" {
+		t.Errorf("identity senders = %v, want [alerts@example.com]", got)
+	}
+
+	if _, err := newCertIdentities([]CertIdentity{{Name: "missing match"}}); err == nil {
+		t.Errorf("newCertIdentities() without match error = nil, want error")
+	}
+}
@@ -0,0 +1,153 @@
+package graphserver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errSendQueueTimeout = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 5},
+	Message:      "Too many messages being sent, try again later",
+}
+
+// sendPool bounds how many messages are sent at once, both in total and for
+// each Graph user, as Exchange throttles mailboxes with more than a few
+// concurrent requests
+type sendPool struct {
+	global  chan struct{}
+	perUser int
+	timeout time.Duration
+
+	mu    sync.Mutex
+	users map[string]*userSlots
+
+	// metrics
+	wait     prometheus.Observer
+	inflight prometheus.Gauge
+}
+
+// userSlots are the send slots of one Graph user, removed once no sends hold
+// or wait for them
+type userSlots struct {
+	sem  chan struct{}
+	refs int
+}
+
+// newSendPool returns a pool allowing global sends in total and perUser sends
+// for each Graph user, where a limit of zero or less is unlimited. If neither
+// is limited nil is returned, which allows every send.
+func newSendPool(global, perUser int) *sendPool {
+	if global <= 0 && perUser <= 0 {
+		return nil
+	}
+
+	p := &sendPool{users: make(map[string]*userSlots)}
+	if global > 0 {
+		p.global = make(chan struct{}, global)
+	}
+	if perUser > 0 {
+		p.perUser = perUser
+	}
+
+	return p
+}
+
+// acquire waits for a slot to send as graphUser of tenant, returning a function
+// that releases it. The slot of the user is taken before a global slot so that
+// a busy mailbox does not hold global slots while it waits. Waits longer than
+// the timeout of the pool fail with errSendQueueTimeout.
+func (p *sendPool) acquire(ctx context.Context, tenant, graphUser string) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, p.timeout, errSendQueueTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	key := tenant + "/" + strings.ToLower(graphUser)
+
+	user := p.user(key)
+	if user != nil {
+		select {
+		case user.sem <- struct{}{}:
+		case <-ctx.Done():
+			p.put(key, user)
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	if p.global != nil {
+		select {
+		case p.global <- struct{}{}:
+		case <-ctx.Done():
+			if user != nil {
+				<-user.sem
+				p.put(key, user)
+			}
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	if p.wait != nil {
+		p.wait.Observe(time.Since(start).Seconds())
+	}
+	if p.inflight != nil {
+		p.inflight.Inc()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if p.inflight != nil {
+				p.inflight.Dec()
+			}
+			if p.global != nil {
+				<-p.global
+			}
+			if user != nil {
+				<-user.sem
+				p.put(key, user)
+			}
+		})
+	}, nil
+}
+
+// user returns the slots of key with a reference taken, or nil if users are
+// not limited
+func (p *sendPool) user(key string) *userSlots {
+	if p.perUser <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.users[key]
+	if !ok {
+		u = &userSlots{sem: make(chan struct{}, p.perUser)}
+		p.users[key] = u
+	}
+	u.refs++
+
+	return u
+}
+
+// put drops a reference to the slots of key taken by user
+func (p *sendPool) put(key string, u *userSlots) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if u.refs--; u.refs == 0 {
+		delete(p.users, key)
+	}
+}
@@ -0,0 +1,89 @@
+package graphserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendPool(t *testing.T) {
+	if p := newSendPool(0, 0); p != nil {
+		t.Errorf("newSendPool(0, 0) = %v, want nil", p)
+	}
+
+	p := newSendPool(2, 1)
+
+	// waits that time out return the context error
+	blocked := func(tenant, user string) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		release, err := p.acquire(ctx, tenant, user)
+		if err == nil {
+			release()
+			return false
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("acquire(%q, %q) error = %v, want %v", tenant, user, err, context.DeadlineExceeded)
+		}
+		return true
+	}
+
+	releaseA, err := p.acquire(context.Background(), DefaultTenant, "a@example.com")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	// users are limited separately and case insensitively
+	if !blocked(DefaultTenant, "A@example.com") {
+		t.Errorf("second send as the same user was not limited")
+	}
+	if blocked("other", "a@example.com") {
+		t.Errorf("send as the same user of another tenant was limited")
+	}
+
+	releaseB, err := p.acquire(context.Background(), DefaultTenant, "b@example.com")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	// both global slots are taken
+	if !blocked(DefaultTenant, "c@example.com") {
+		t.Errorf("send over the global limit was not limited")
+	}
+
+	releaseA()
+	releaseA()
+	if blocked(DefaultTenant, "c@example.com") {
+		t.Errorf("send was limited after a slot was released")
+	}
+	releaseB()
+
+	if n := len(p.users); n != 0 {
+		t.Errorf("pool has %d users after all sends finished, want 0", n)
+	}
+}
+
+func TestSendPoolQueueTimeout(t *testing.T) {
+	p := newSendPool(1, 0)
+	p.timeout = 20 * time.Millisecond
+
+	release, err := p.acquire(context.Background(), DefaultTenant, "a@example.com")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	defer release()
+
+	// a send waiting longer than the queue timeout is deferred
+	if _, err := p.acquire(context.Background(), DefaultTenant, "b@example.com"); !errors.Is(err, errSendQueueTimeout) {
+		t.Errorf("acquire() over the queue timeout error = %v, want %v", err, errSendQueueTimeout)
+	}
+
+	// cancellation of the caller is still reported as such
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.acquire(ctx, DefaultTenant, "b@example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,130 @@
+package graphserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service shutting down, try again later",
+}
+
+// abortWait bounds how long cancelled sends are waited for once the grace
+// period has expired
+const abortWait = 10 * time.Second
+
+// drainer tracks in-flight DATA transactions so shutdown can wait for them to
+// finish before connections are closed
+type drainer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	draining bool
+	inflight int
+	idle     chan struct{}
+}
+
+func newDrainer(ctx context.Context) *drainer {
+	d := &drainer{}
+	d.ctx, d.cancel = context.WithCancel(ctx)
+
+	return d
+}
+
+// context returns the context sends are made with, which is cancelled if the
+// grace period expires
+func (d *drainer) context() context.Context {
+	if d == nil {
+		return context.Background()
+	}
+
+	return d.ctx
+}
+
+// closed reports whether new transactions are refused
+func (d *drainer) closed() bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.draining
+}
+
+// begin marks the start of a transaction, returning false if draining
+func (d *drainer) begin() bool {
+	if d == nil {
+		return true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.inflight++
+
+	return true
+}
+
+// end marks the end of a transaction started by begin
+func (d *drainer) end() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inflight--
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// drain refuses new transactions and waits for those in flight until ctx is
+// done, after which sends are cancelled. It returns how many transactions
+// finished and how many were aborted.
+func (d *drainer) drain(ctx context.Context) (int, int) {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return 0, 0
+	}
+	d.draining = true
+	inflight := d.inflight
+	d.idle = make(chan struct{})
+	if inflight == 0 {
+		close(d.idle)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.idle:
+		d.cancel()
+		return inflight, 0
+	case <-ctx.Done():
+	}
+
+	// the grace period expired, so abort the remaining sends
+	d.mu.Lock()
+	aborted := d.inflight
+	d.mu.Unlock()
+	d.cancel()
+
+	select {
+	case <-d.idle:
+	case <-time.After(abortWait):
+	}
+
+	return inflight - aborted, aborted
+}
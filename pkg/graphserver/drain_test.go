@@ -0,0 +1,99 @@
+package graphserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
+)
+
+func TestDrainWaitsForTransactions(t *testing.T) {
+	d := newDrainer(context.Background())
+
+	if !d.begin() {
+		t.Fatalf("begin() = false before draining, want true")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		d.end()
+	}()
+
+	drained, aborted := d.drain(context.Background())
+	if drained != 1 || aborted != 0 {
+		t.Errorf("drain() = %d, %d, want 1, 0", drained, aborted)
+	}
+
+	if d.begin() {
+		t.Errorf("begin() = true while draining, want false")
+	}
+	if !d.closed() {
+		t.Errorf("closed() = false after drain, want true")
+	}
+}
+
+func TestDrainAbortsAfterGrace(t *testing.T) {
+	d := newDrainer(context.Background())
+	d.begin()
+
+	// the send ends once its context is cancelled
+	go func() {
+		<-d.context().Done()
+		d.end()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	drained, aborted := d.drain(ctx)
+	if drained != 0 || aborted != 1 {
+		t.Errorf("drain() = %d, %d, want 0, 1", drained, aborted)
+	}
+}
+
+// blockingSender sends until its context is cancelled
+type blockingSender struct {
+	started chan struct{}
+}
+
+func (s *blockingSender) SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error {
+	close(s.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDrainSpooledDeliveries(t *testing.T) {
+	sender := &blockingSender{started: make(chan struct{})}
+	b, err := NewBackend(sender, WithPrometheusRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+
+	msg := &spool.Message{From: "sender@example.com", Recipients: []string{"rcpt@example.com"}, MIME: []byte("Subject: test\r\n\r\n")}
+
+	// the spool does not cancel deliveries in progress, so only the grace
+	// period ends the send
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- b.Deliver(context.Background(), msg)
+	}()
+	<-sender.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	drained, aborted := b.Drain(ctx)
+	if drained != 0 || aborted != 1 {
+		t.Errorf("Drain() = %d, %d, want 0, 1", drained, aborted)
+	}
+	if err := <-delivered; !errors.Is(err, context.Canceled) {
+		t.Errorf("Deliver() error = %v, want %v", err, context.Canceled)
+	}
+
+	if err := b.Deliver(context.Background(), msg); !errors.Is(err, errShuttingDown) {
+		t.Errorf("Deliver() while draining error = %v, want %v", err, errShuttingDown)
+	}
+}
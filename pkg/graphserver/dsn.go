@@ -0,0 +1,296 @@
+package graphserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
+)
+
+// DefaultNoBounceSenders are envelope senders that are not sent bounces, as
+// they are not expected to read replies
+var DefaultNoBounceSenders = []string{
+	"noreply@*",
+	"no-reply@*",
+	"donotreply@*",
+	"do-not-reply@*",
+	"mailer-daemon@*",
+}
+
+const bounceSubject = "Undelivered Mail Returned to Sender"
+
+// Bounce sends an RFC 3464 delivery status notification to the envelope sender
+// of a message that could not be delivered. It is intended to be used as the
+// failure function of the spool passed to WithSpool, which the bounce is
+// queued on.
+func (b *Backend) Bounce(msg *spool.Message, err error) {
+	if reason := b.suppressBounce(msg); reason != "" {
+		if b.logger != nil {
+			b.logger.Info("bounce suppressed", "id", msg.ID, "from", msg.From, "reason", reason)
+		}
+		return
+	}
+
+	sender, dsnErr := b.bounceFrom(msg)
+	if dsnErr != nil {
+		if b.logger != nil {
+			b.logger.Error("could not create bounce", "id", msg.ID, "error", dsnErr, "from", msg.From)
+		}
+		return
+	}
+
+	dsn, dsnErr := buildDSN(b.domain, sender, b.remoteMTA(msg), msg, err, time.Now())
+	if dsnErr != nil {
+		if b.logger != nil {
+			b.logger.Error("could not create bounce", "id", msg.ID, "error", dsnErr, "from", msg.From)
+		}
+		return
+	}
+
+	bounce := &spool.Message{
+		GraphUser:  msg.GraphUser,
+		Tenant:     msg.Tenant,
+		From:       sender,
+		Recipients: []string{msg.From},
+		MIME:       dsn,
+	}
+
+	if dsnErr := b.spool.Enqueue(bounce); dsnErr != nil {
+		if b.logger != nil {
+			b.logger.Error("could not send bounce", "id", msg.ID, "error", dsnErr, "from", msg.From)
+		}
+		return
+	}
+
+	b.bounces.Inc()
+	if b.logger != nil {
+		b.logger.Info("bounce sent", "id", msg.ID, "from", sender, "to", msg.From)
+	}
+}
+
+// bounceFrom returns the address a bounce for msg is sent from, which is the
+// Graph user of the message if no bounce sender is set. The Graph user may be
+// an object id rather than a mailbox, so it is only used if it is a mailbox.
+func (b *Backend) bounceFrom(msg *spool.Message) (string, error) {
+	if b.bounceSender != "" {
+		return b.bounceSender, nil
+	}
+
+	sender, err := normalizeMailbox(msg.GraphUser)
+	if err != nil {
+		return "", fmt.Errorf("graph user %q is not a mailbox and no bounce sender is set: %w", msg.GraphUser, err)
+	}
+
+	return sender, nil
+}
+
+// remoteMTA returns the host of the route msg failed on, which is the
+// fallback if it was tried, or "" if the route does not deliver to a host
+func (b *Backend) remoteMTA(msg *spool.Message) string {
+	var sender Sender
+	if msg.Route == RouteFallback {
+		sender = b.fallback
+	} else if t := b.tenants.get(msg.Tenant); t != nil {
+		sender = t.sender
+	}
+
+	if h, ok := sender.(hoster); ok {
+		return h.Host()
+	}
+
+	return ""
+}
+
+// suppressBounce returns why no bounce should be sent for msg, or "" if one
+// should be sent
+func (b *Backend) suppressBounce(msg *spool.Message) string {
+	if !b.bounce {
+		return "bounces disabled"
+	}
+
+	if msg.From == "" {
+		return "null sender"
+	}
+
+	for _, pattern := range b.noBounceSenders {
+		if ok, _ := path.Match(pattern, msg.From); ok {
+			return "no-reply sender"
+		}
+	}
+
+	// never bounce a bounce
+	if msg.From == b.bounceSender || isDSN(msg.MIME) {
+		return "message is a bounce"
+	}
+
+	return ""
+}
+
+func isDSN(mimeMessage []byte) bool {
+	header, _ := headerSection(mimeMessage)
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status")
+}
+
+// headerSection parses the header of a MIME message, returning it along with
+// its raw bytes
+func headerSection(mimeMessage []byte) (mail.Header, []byte) {
+	end := len(mimeMessage)
+	if i := bytes.Index(mimeMessage, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 2
+	} else if i := bytes.Index(mimeMessage, []byte("\n\n")); i >= 0 {
+		end = i + 1
+	}
+	raw := mimeMessage[:end]
+
+	msg, err := mail.ReadMessage(bytes.NewReader(mimeMessage))
+	if err != nil {
+		return mail.Header{}, raw
+	}
+
+	return msg.Header, raw
+}
+
+// buildDSN creates a multipart/report delivery status notification for msg
+func buildDSN(domain, sender, remoteMTA string, msg *spool.Message, deliveryErr error, now time.Time) ([]byte, error) {
+	boundary, err := randomHex(12)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	status := dsnStatus(deliveryErr)
+	diagnostic := dsnDiagnostic(deliveryErr)
+	_, originalHeader := headerSection(msg.MIME)
+
+	var buf bytes.Buffer
+	crlf := func(format string, args ...any) {
+		fmt.Fprintf(&buf, format+"\r\n", args...)
+	}
+
+	// message header
+	crlf("From: Mail Delivery System <%s>", sender)
+	crlf("To: <%s>", msg.From)
+	crlf("Subject: %s", bounceSubject)
+	crlf("Date: %s", now.Format(time.RFC1123Z))
+	crlf("Message-ID: <%s@%s>", id, domain)
+	crlf("Auto-Submitted: auto-replied")
+	crlf("MIME-Version: 1.0")
+	crlf("Content-Type: multipart/report; report-type=delivery-status; boundary=%q", boundary)
+	crlf("")
+
+	// human readable explanation
+	crlf("--%s", boundary)
+	crlf("Content-Type: text/plain; charset=utf-8")
+	crlf("")
+	crlf("This is the mail system at host %s.", domain)
+	crlf("")
+	crlf("Your message could not be delivered to one or more recipients.")
+	crlf("")
+	for _, rcpt := range msg.Recipients {
+		crlf("<%s>: %s", rcpt, diagnostic)
+	}
+	crlf("")
+
+	// machine readable status
+	crlf("--%s", boundary)
+	crlf("Content-Type: message/delivery-status")
+	crlf("")
+	crlf("Reporting-MTA: dns; %s", domain)
+	crlf("X-Spool-Id: %s", msg.ID)
+	crlf("Arrival-Date: %s", msg.Created.Format(time.RFC1123Z))
+	for _, rcpt := range msg.Recipients {
+		crlf("")
+		crlf("Final-Recipient: rfc822; %s", rcpt)
+		crlf("Action: failed")
+		crlf("Status: %s", status)
+		if remoteMTA != "" {
+			crlf("Remote-MTA: dns; %s", remoteMTA)
+		}
+		crlf("Diagnostic-Code: X-Graph; %s", diagnostic)
+		crlf("Last-Attempt-Date: %s", now.Format(time.RFC1123Z))
+	}
+	crlf("")
+
+	// original message header
+	crlf("--%s", boundary)
+	crlf("Content-Type: text/rfc822-headers")
+	crlf("")
+	buf.Write(toCRLF(originalHeader))
+	crlf("")
+	crlf("--%s--", boundary)
+
+	return buf.Bytes(), nil
+}
+
+// dsnStatus maps a delivery error to an RFC 3463 enhanced status code
+func dsnStatus(err error) string {
+	if errors.Is(err, graphclient.ErrMessageTooLarge) {
+		return "5.3.4"
+	}
+
+	switch graphclient.StatusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "5.7.1"
+	case http.StatusNotFound:
+		// the Graph user sent as is missing, not the recipient
+		return "5.0.0"
+	case http.StatusRequestEntityTooLarge:
+		return "5.3.4"
+	}
+
+	if spool.IsPermanent(err) || permanent(err) {
+		return "5.0.0"
+	}
+
+	// otherwise delivery was retried until the spool expiry
+	return "5.4.7"
+}
+
+// dsnDiagnostic describes a delivery error on a single line, including the
+// Graph status and error code when available
+func dsnDiagnostic(err error) string {
+	var parts []string
+	if code := graphclient.StatusCode(err); code != 0 {
+		parts = append(parts, fmt.Sprintf("%d", code))
+	}
+	if code := graphclient.ErrorCode(err); code != "" {
+		parts = append(parts, code)
+	}
+	if err != nil {
+		parts = append(parts, strings.Join(strings.Fields(err.Error()), " "))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func toCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate random id: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,222 @@
+package graphserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
+)
+
+func TestBuildDSN(t *testing.T) {
+	msg := &spool.Message{
+		ID:         "1-abc",
+		GraphUser:  "relay@example.com",
+		From:       "printer@example.com",
+		Recipients: []string{"alice@example.net", "bob@example.net"},
+		Created:    time.Now().Add(-time.Hour),
+		MIME:       []byte("From: printer@example.com\nSubject: Scan\n\nbody that must not be returned\n"),
+	}
+
+	code, message := "ErrorSendAsDenied", "The user account which was used to submit this request does not have the right to send mail on behalf of the specified sending account."
+	main := odataerrors.NewMainError()
+	main.SetCode(&code)
+	main.SetMessage(&message)
+	graphErr := odataerrors.NewODataError()
+	graphErr.SetErrorEscaped(main)
+	graphErr.SetStatusCode(403)
+
+	dsn, err := buildDSN("proxy.example.com", "postmaster@example.com", "graph.microsoft.com", msg, spool.Permanent(graphErr), time.Now())
+	if err != nil {
+		t.Fatalf("buildDSN() error = %v", err)
+	}
+
+	if !isDSN(dsn) {
+		t.Fatalf("isDSN() = false for generated bounce")
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(dsn))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage() error = %v", err)
+	}
+	if got := parsed.Header.Get("To"); got != "<printer@example.com>" {
+		t.Errorf("To = %q, want envelope sender", got)
+	}
+
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("mime.ParseMediaType() error = %v", err)
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	parts := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart() error = %v", err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("io.ReadAll() error = %v", err)
+		}
+		parts[part.Header.Get("Content-Type")] = string(body)
+	}
+
+	status := parts["message/delivery-status"]
+	for _, want := range []string{
+		"Reporting-MTA: dns; proxy.example.com",
+		"Final-Recipient: rfc822; alice@example.net",
+		"Final-Recipient: rfc822; bob@example.net",
+		"Status: 5.7.1",
+		"Remote-MTA: dns; graph.microsoft.com",
+		"Diagnostic-Code: X-Graph; 403 ErrorSendAsDenied The user account",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("delivery-status missing %q:\n%s", want, status)
+		}
+	}
+
+	headers := parts["text/rfc822-headers"]
+	if !strings.Contains(headers, "Subject: Scan\r\n") {
+		t.Errorf("rfc822-headers missing original headers:\n%s", headers)
+	}
+	if strings.Contains(headers, "body that must not be returned") {
+		t.Errorf("rfc822-headers contains original body")
+	}
+}
+
+func TestDSNStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"too large", fmt.Errorf("could not split message: %w", graphclient.ErrMessageTooLarge), "5.3.4"},
+		{"forbidden", graphError(403), "5.7.1"},
+		{"unknown graph user", graphError(404), "5.0.0"},
+		{"permanent", spool.Permanent(errors.New("rejected")), "5.0.0"},
+		{"expired", graphError(503), "5.4.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dsnStatus(tt.err); got != tt.want {
+				t.Errorf("dsnStatus(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuppressBounce(t *testing.T) {
+	b := &Backend{bounce: true, noBounceSenders: DefaultNoBounceSenders, bounceSender: "postmaster@example.com"}
+
+	tests := []struct {
+		from     string
+		mime     string
+		suppress bool
+	}{
+		{"printer@example.com", "Subject: test\r\n\r\n", false},
+		{"noreply@example.com", "Subject: test\r\n\r\n", true},
+		{"postmaster@example.com", "Subject: test\r\n\r\n", true},
+		{"printer@example.com", "Content-Type: multipart/report; report-type=delivery-status; boundary=x\r\n\r\n", true},
+		{"", "Subject: test\r\n\r\n", true},
+	}
+
+	for _, tt := range tests {
+		reason := b.suppressBounce(&spool.Message{From: tt.from, MIME: []byte(tt.mime)})
+		if (reason != "") != tt.suppress {
+			t.Errorf("suppressBounce(%q) = %q, want suppress %v", tt.from, reason, tt.suppress)
+		}
+	}
+
+	b.bounce = false
+	if reason := b.suppressBounce(&spool.Message{From: "printer@example.com"}); reason == "" {
+		t.Errorf("suppressBounce() did not suppress with bounces disabled")
+	}
+}
+
+func TestBounceFrom(t *testing.T) {
+	b := &Backend{}
+	if got, err := b.bounceFrom(&spool.Message{GraphUser: "Relay@Example.com"}); err != nil || got != "relay@example.com" {
+		t.Errorf("bounceFrom() = %q, %v, want relay@example.com", got, err)
+	}
+	if _, err := b.bounceFrom(&spool.Message{GraphUser: "6f1c2b3a-9d8e-4f70-a1b2-c3d4e5f60718"}); err == nil {
+		t.Errorf("bounceFrom() with an object id Graph user error = nil, want error")
+	}
+
+	b.bounceSender = "postmaster@example.com"
+	if got, err := b.bounceFrom(&spool.Message{GraphUser: "6f1c2b3a-9d8e-4f70-a1b2-c3d4e5f60718"}); err != nil || got != "postmaster@example.com" {
+		t.Errorf("bounceFrom() = %q, %v, want postmaster@example.com", got, err)
+	}
+}
+
+type hostSender struct {
+	testSender
+	host string
+}
+
+func (s *hostSender) Host() string {
+	return s.host
+}
+
+func TestRemoteMTA(t *testing.T) {
+	primary := newTestTenant(&hostSender{host: "graph.microsoft.com"})
+	primary.Name = DefaultTenant
+	b := &Backend{
+		tenants:  &tenantSet{tenants: []*tenant{primary}, fallback: primary},
+		fallback: &hostSender{host: "relay.example.com"},
+	}
+
+	tests := []struct {
+		name  string
+		route string
+		want  string
+	}{
+		{"primary", RoutePrimary, "graph.microsoft.com"},
+		{"fallback", RouteFallback, "relay.example.com"},
+		{"not attempted", "", "graph.microsoft.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.remoteMTA(&spool.Message{Route: tt.route}); got != tt.want {
+				t.Errorf("remoteMTA() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// senders that do not deliver to a host are not reported
+	b.fallback = &testSender{}
+	if got := b.remoteMTA(&spool.Message{Route: RouteFallback}); got != "" {
+		t.Errorf("remoteMTA() = %q, want \"\"", got)
+	}
+}
+
+func TestBounceSenderRequired(t *testing.T) {
+	routes := WithSendUserRoutes([]SendUserRoute{{Senders: []string{"*@scan.example.com"}, GraphUser: "6f1c2b3a-9d8e-4f70-a1b2-c3d4e5f60718"}})
+
+	if _, err := NewBackend(&userSender{}, routes, WithPrometheusRegistry(prometheus.NewRegistry())); err == nil {
+		t.Errorf("NewBackend() with an object id send user and no bounce sender error = nil, want error")
+	}
+
+	if _, err := NewBackend(&userSender{}, routes, WithBounceSender("postmaster@example.com"), WithPrometheusRegistry(prometheus.NewRegistry())); err != nil {
+		t.Errorf("NewBackend() with a bounce sender error = %v", err)
+	}
+
+	if _, err := NewBackend(&userSender{}, routes, WithBounces(false), WithPrometheusRegistry(prometheus.NewRegistry())); err != nil {
+		t.Errorf("NewBackend() with bounces disabled error = %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package graphserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+)
+
+// Routes a message may be delivered by, used as the route log field and
+// metric label
+const (
+	RoutePrimary  = "primary"
+	RouteFallback = "fallback"
+)
+
+// router delivers messages with the sender of their tenant, falling back to a
+// secondary route when the primary is unavailable
+type router struct {
+	fallback Sender
+	pool     *sendPool
+
+	// metrics
+	delivered *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+}
+
+// send delivers a message for tenant t, returning the route that was used
+func (r *router) send(ctx context.Context, t *tenant, graphUser, from string, recipients []string, mime []byte) (string, error) {
+	release, err := r.pool.acquire(ctx, t.Name, graphUser)
+	if err != nil {
+		return RoutePrimary, err
+	}
+	defer release()
+
+	err = t.send(ctx, graphUser, from, recipients, mime)
+	if err == nil {
+		r.delivered.WithLabelValues(RoutePrimary).Inc()
+		return RoutePrimary, nil
+	}
+	r.errors.WithLabelValues(RoutePrimary).Inc()
+
+	if r.fallback == nil || !useFallback(err) {
+		return RoutePrimary, err
+	}
+
+	// failures of the fallback do not change whether the message is retried
+	if fallbackErr := r.fallback.SendMime(ctx, graphUser, from, recipients, mime); fallbackErr != nil {
+		r.errors.WithLabelValues(RouteFallback).Inc()
+		return RouteFallback, fmt.Errorf("%w (fallback failed: %v)", err, fallbackErr)
+	}
+
+	r.delivered.WithLabelValues(RouteFallback).Inc()
+	return RouteFallback, nil
+}
+
+// useFallback reports whether a message that failed with err should be sent by
+// the fallback route. This is only the case when the primary route cannot have
+// accepted the message, as it could not authenticate or failed before the
+// message was submitted, so a message is never delivered by both routes.
+func useFallback(err error) bool {
+	if permanent(err) || errors.Is(err, context.Canceled) || errors.Is(err, graphclient.ErrSendUnknown) {
+		return false
+	}
+
+	switch graphclient.StatusCode(err) {
+	case 0, http.StatusUnauthorized, http.StatusForbidden:
+		// network errors before the send and token errors have no status
+		return true
+	}
+
+	return graphclient.IsTransient(err)
+}
@@ -0,0 +1,99 @@
+package graphserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/relayclient"
+)
+
+type testSender struct {
+	err  error
+	sent int
+}
+
+func (s *testSender) SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent++
+	return nil
+}
+
+func graphError(status int) error {
+	err := odataerrors.NewODataError()
+	err.SetStatusCode(status)
+	return err
+}
+
+func newTestRouter(fallback Sender) *router {
+	return &router{
+		fallback:  fallback,
+		delivered: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "delivered"}, []string{"route"}),
+		errors:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"route"}),
+	}
+}
+
+func newTestTenant(sender Sender) *tenant {
+	return &tenant{
+		sender: sender,
+		sent:   prometheus.NewCounter(prometheus.CounterOpts{Name: "sent"}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"}),
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantRoute string
+		wantErr   bool
+	}{
+		{"primary delivers", nil, RoutePrimary, false},
+		{"network error", errors.New("dial tcp: i/o timeout"), RouteFallback, false},
+		{"message too large", graphclient.ErrMessageTooLarge, RoutePrimary, true},
+		{"rejected", &relayclient.ReplyError{Code: 550}, RoutePrimary, true},
+		{"cancelled", context.Canceled, RoutePrimary, true},
+		{"deadline before send", fmt.Errorf("could not patch draft: %w", context.DeadlineExceeded), RouteFallback, false},
+		{"deadline sending", fmt.Errorf("could not send draft message, %w: %w", graphclient.ErrSendUnknown, context.DeadlineExceeded), RoutePrimary, true},
+		{"unauthorized", graphError(http.StatusUnauthorized), RouteFallback, false},
+		{"throttled before send", fmt.Errorf("could not create MIME draft: %w", graphError(http.StatusServiceUnavailable)), RouteFallback, false},
+		{"network error sending", fmt.Errorf("could not send draft message, %w: %w", graphclient.ErrSendUnknown, errors.New("connection reset by peer")), RoutePrimary, true},
+		{"server error sending", fmt.Errorf("could not send draft message, %w: %w", graphclient.ErrSendUnknown, graphError(http.StatusBadGateway)), RoutePrimary, true},
+	}
+
+	for _, tt := range tests {
+		fallback := &testSender{}
+		r := newTestRouter(fallback)
+
+		route, err := r.send(context.Background(), newTestTenant(&testSender{err: tt.err}), "", "from@example.com", []string{"to@example.com"}, nil)
+		if route != tt.wantRoute || (err != nil) != tt.wantErr {
+			t.Errorf("%s: send() = %q, %v, want %q, error %v", tt.name, route, err, tt.wantRoute, tt.wantErr)
+		}
+
+		if got := testutil.ToFloat64(r.delivered.WithLabelValues(RouteFallback)); got != float64(fallback.sent) {
+			t.Errorf("%s: fallback delivered metric = %v, want %d", tt.name, got, fallback.sent)
+		}
+	}
+
+	// the primary error decides whether a message is retried when both fail
+	primaryErr := errors.New("connection refused")
+	r := newTestRouter(&testSender{err: &relayclient.ReplyError{Code: 554}})
+	route, err := r.send(context.Background(), newTestTenant(&testSender{err: primaryErr}), "", "from@example.com", []string{"to@example.com"}, nil)
+	if route != RouteFallback || !errors.Is(err, primaryErr) || permanent(err) {
+		t.Errorf("send() with failed fallback = %q, %v, want temporary primary error", route, err)
+	}
+
+	// without a fallback the primary error is returned
+	r = newTestRouter(nil)
+	if route, err := r.send(context.Background(), newTestTenant(&testSender{err: primaryErr}), "", "from@example.com", nil, nil); route != RoutePrimary || !errors.Is(err, primaryErr) {
+		t.Errorf("send() without fallback = %q, %v, want primary error", route, err)
+	}
+}
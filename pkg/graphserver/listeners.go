@@ -0,0 +1,77 @@
+package graphserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+// Listener overrides the access controls of the backend for the connections
+// accepted by one SMTP server, so that several servers may share a backend.
+type Listener struct {
+	// Name identifies the listener in logs
+	Name string
+	// AllowedSources and DeniedSources replace those of the backend when
+	// either is set
+	AllowedSources []string
+	DeniedSources  []string
+	// RequireAuth requires every client to authenticate, as RelayDisabled does
+	RequireAuth bool
+	// RequireTLS refuses AUTH and MAIL on connections that are not encrypted,
+	// which is always the case if the backend requires TLS
+	RequireTLS bool
+}
+
+// listener holds the access controls applied to a session
+type listener struct {
+	name       string
+	sources    *sourcePolicy
+	relay      string
+	requireTLS bool
+}
+
+// listenerBackend is the smtp.Backend of a listener sharing a Backend
+type listenerBackend struct {
+	backend  *Backend
+	listener *listener
+}
+
+// NewSession is called after client greeting (EHLO, HELO).
+func (l *listenerBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return l.backend.newSession(c, l.listener)
+}
+
+// ForListener returns an smtp.Backend that shares b but applies the access
+// controls of l to the connections it is given
+func (b *Backend) ForListener(l Listener) (smtp.Backend, error) {
+	ln := &listener{
+		name:       strings.TrimSpace(l.Name),
+		sources:    b.sources,
+		relay:      b.relay,
+		requireTLS: l.RequireTLS || b.requireTLS,
+	}
+
+	if len(l.AllowedSources) > 0 || len(l.DeniedSources) > 0 {
+		sources, err := newSourcePolicy(l.AllowedSources, l.DeniedSources)
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %w", ln.name, err)
+		}
+		ln.sources = sources
+	}
+
+	if l.RequireAuth {
+		if b.users == nil {
+			return nil, fmt.Errorf("listener %q cannot require authentication without a users file", ln.name)
+		}
+		ln.relay = RelayDisabled
+	}
+
+	return &listenerBackend{backend: b, listener: ln}, nil
+}
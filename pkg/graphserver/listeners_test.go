@@ -0,0 +1,84 @@
+package graphserver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestForListener(t *testing.T) {
+	sources, err := newSourcePolicy([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("newSourcePolicy() error = %v", err)
+	}
+	b := &Backend{sources: sources, relay: RelaySources}
+
+	be, err := b.ForListener(Listener{Name: "lan", AllowedSources: []string{"192.168.0.0/16"}, RequireTLS: true})
+	if err != nil {
+		t.Fatalf("ForListener() error = %v", err)
+	}
+	l := be.(*listenerBackend).listener
+	if trusted, _ := l.sources.check("192.168.1.10:25"); !trusted {
+		t.Errorf("listener sources did not replace backend sources")
+	}
+	if l.relay != RelaySources || !l.requireTLS {
+		t.Errorf("listener = %+v, want relay from sources with TLS required", l)
+	}
+
+	// listeners without sources use those of the backend
+	be, err = b.ForListener(Listener{Name: "default"})
+	if err != nil {
+		t.Fatalf("ForListener() error = %v", err)
+	}
+	if be.(*listenerBackend).listener.sources != sources {
+		t.Errorf("listener without sources did not use backend sources")
+	}
+
+	if _, err := b.ForListener(Listener{Name: "submission", RequireAuth: true}); err == nil {
+		t.Errorf("ForListener() requiring auth without users error = nil, want error")
+	}
+}
+
+func TestSessionRequiresTLS(t *testing.T) {
+	s := &Session{
+		tenants:    &tenantSet{},
+		requireTLS: true,
+		sendDenied: prometheus.NewCounter(prometheus.CounterOpts{Name: "denied"}),
+	}
+
+	if err := s.Mail("user@example.com", nil); !errors.Is(err, errTLSRequired) {
+		t.Errorf("Mail() without TLS error = %v, want %v", err, errTLSRequired)
+	}
+
+	s.users = map[string]*authUser{}
+	if _, err := s.Auth("PLAIN"); !errors.Is(err, errTLSRequired) {
+		t.Errorf("Auth() without TLS error = %v, want %v", err, errTLSRequired)
+	}
+}
+
+func TestTLSRequired(t *testing.T) {
+	exemptions, err := parsePrefixes([]string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatalf("parsePrefixes() error = %v", err)
+	}
+	b := &Backend{tlsExemptions: exemptions}
+
+	tests := []struct {
+		requireTLS bool
+		remote     string
+		want       bool
+	}{
+		{false, "192.0.2.1:2525", false},
+		{true, "192.0.2.1:2525", true},
+		{true, "10.0.0.20:2525", false},
+		{true, "[::ffff:10.0.0.20]:2525", false},
+		{true, "invalid", true},
+	}
+
+	for _, tt := range tests {
+		if got := b.tlsRequired(&listener{requireTLS: tt.requireTLS}, tt.remote); got != tt.want {
+			t.Errorf("tlsRequired(%v, %q) = %v, want %v", tt.requireTLS, tt.remote, got, tt.want)
+		}
+	}
+}
@@ -2,19 +2,46 @@ package graphserver
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/mail"
+	"slices"
 	"sort"
 	"strings"
 )
 
-const maxGraphMIMEEncodedBytes = int(3.75 * 1024 * 1024)
+// Envelope modes control how the SMTP envelope is applied to MIME headers
+const (
+	// EnvelopeOverride replaces To with every envelope recipient and removes Cc
+	EnvelopeOverride = "override"
+	// EnvelopePreserve keeps To and Cc limited to envelope recipients, with any
+	// remaining envelope recipients delivered as Bcc
+	EnvelopePreserve = "preserve"
+)
+
+// Envelope is the SMTP envelope applied to a message by PrepareGraphMIME
+type Envelope struct {
+	From       string
+	Recipients []string
+
+	// Mode is EnvelopeOverride (the default) or EnvelopePreserve
+	Mode string
 
-func prepareGraphMIME(raw []byte, from string, recipients []string) ([]byte, error) {
+	// DisplayName replaces the display name of the From header when set
+	DisplayName string
+
+	// OriginalSender is the envelope sender before it was rewritten, which is
+	// kept in the header selected by OriginalHeader
+	OriginalSender string
+	OriginalHeader string
+}
+
+// PrepareGraphMIME validates a raw MIME message and applies the SMTP envelope
+// to its headers, returning the payload to pass to graphclient.SendMime along
+// with the same envelope.
+func PrepareGraphMIME(raw []byte, env Envelope) ([]byte, error) {
 	if len(raw) == 0 {
 		return nil, fmt.Errorf("message data was empty")
 	}
@@ -25,9 +52,21 @@ func prepareGraphMIME(raw []byte, from string, recipients []string) ([]byte, err
 	}
 
 	headers := cloneHeader(msg.Header)
-	setHeader(headers, "From", from)
-	setHeader(headers, "To", strings.Join(recipients, ", "))
-	delete(headers, "Cc")
+	setHeader(headers, "From", fromHeader(msg.Header, env.From, env.DisplayName))
+	switch env.Mode {
+	case EnvelopePreserve:
+		for _, key := range []string{"To", "Cc"} {
+			if err := filterAddressHeader(headers, key, env.Recipients); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		setHeader(headers, "To", strings.Join(env.Recipients, ", "))
+		delete(headers, "Cc")
+	}
+	if env.OriginalSender != "" && !strings.EqualFold(env.OriginalSender, env.From) {
+		setOriginalSender(headers, env.OriginalHeader, env.OriginalSender)
+	}
 	delete(headers, "Bcc")
 	delete(headers, "Sender")
 	delete(headers, "Return-Path")
@@ -41,10 +80,6 @@ func prepareGraphMIME(raw []byte, from string, recipients []string) ([]byte, err
 		return nil, fmt.Errorf("final MIME payload was invalid: %w", err)
 	}
 
-	if encodedLen := base64.StdEncoding.EncodedLen(len(payload)); encodedLen > maxGraphMIMEEncodedBytes {
-		return nil, fmt.Errorf("base64 encoded MIME payload size %d exceeds limit %d", encodedLen, maxGraphMIMEEncodedBytes)
-	}
-
 	return payload, nil
 }
 
@@ -131,6 +166,61 @@ func cloneHeader(header mail.Header) mail.Header {
 	return clone
 }
 
+// filterAddressHeader removes any addresses from the header that are not
+// envelope recipients. The header is left untouched if nothing was removed.
+func filterAddressHeader(header mail.Header, key string, recipients []string) error {
+	if header.Get(key) == "" {
+		delete(header, key)
+		return nil
+	}
+
+	addresses, err := header.AddressList(key)
+	if err != nil {
+		return fmt.Errorf("invalid %s header: %w", key, err)
+	}
+
+	kept := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if slices.Contains(recipients, strings.ToLower(address.Address)) {
+			kept = append(kept, address.String())
+		}
+	}
+
+	switch {
+	case len(kept) == 0:
+		delete(header, key)
+	case len(kept) < len(addresses) || len(header[key]) > 1:
+		setHeader(header, key, strings.Join(kept, ", "))
+	}
+
+	return nil
+}
+
+// fromHeader returns the From header for the envelope sender, using name or
+// otherwise keeping the display name of the original From header when it is
+// the same mailbox
+func fromHeader(header mail.Header, from, name string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return from
+	}
+
+	if name != "" {
+		addr.Name = name
+	} else if addr.Name == "" {
+		original, err := header.AddressList("From")
+		if err == nil && len(original) == 1 && strings.EqualFold(original[0].Address, addr.Address) {
+			addr.Name = original[0].Name
+		}
+	}
+
+	if addr.Name == "" {
+		return addr.Address
+	}
+
+	return addr.String()
+}
+
 func setHeader(header mail.Header, key, value string) {
 	header[key] = []string{value}
 }
@@ -1,7 +1,6 @@
 package graphserver
 
 import (
-	"encoding/base64"
 	"net/mail"
 	"strings"
 	"testing"
@@ -39,9 +38,9 @@ func TestPrepareGraphMIMEOverridesEnvelopeHeaders(t *testing.T) {
 		"",
 	}, "\r\n")
 
-	payload, err := prepareGraphMIME([]byte(raw), "test1@example.com", []string{"test1@example.com", "test2@example.com"})
+	payload, err := PrepareGraphMIME([]byte(raw), Envelope{From: "test1@example.com", Recipients: []string{"test1@example.com", "test2@example.com"}, Mode: EnvelopeOverride})
 	if err != nil {
-		t.Fatalf("prepareGraphMIME() error = %v", err)
+		t.Fatalf("PrepareGraphMIME() error = %v", err)
 	}
 
 	msg, err := mail.ReadMessage(strings.NewReader(string(payload)))
@@ -70,6 +69,72 @@ func TestPrepareGraphMIMEOverridesEnvelopeHeaders(t *testing.T) {
 	}
 }
 
+func TestPrepareGraphMIMEKeepsFromDisplayName(t *testing.T) {
+	tests := []struct {
+		header   string
+		wantName string
+	}{
+		{"Test User <TEST1@example.com>", "Test User"},
+		{"Other User <other@example.com>", ""},
+	}
+
+	for _, tt := range tests {
+		raw := "From: " + tt.header + "\r\nTo: test2@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+		payload, err := PrepareGraphMIME([]byte(raw), Envelope{From: "test1@example.com", Recipients: []string{"test2@example.com"}, Mode: EnvelopeOverride})
+		if err != nil {
+			t.Fatalf("PrepareGraphMIME() error = %v", err)
+		}
+
+		msg, err := mail.ReadMessage(strings.NewReader(string(payload)))
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		from, err := msg.Header.AddressList("From")
+		if err != nil || len(from) != 1 {
+			t.Fatalf("From = %q (%v), want one address", msg.Header.Get("From"), err)
+		}
+		if from[0].Address != "test1@example.com" || from[0].Name != tt.wantName {
+			t.Errorf("From with original %q = %q <%s>, want %q <test1@example.com>", tt.header, from[0].Name, from[0].Address, tt.wantName)
+		}
+	}
+}
+
+func TestPrepareGraphMIMEPreservesVisibleRecipients(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: Original Sender <original@example.com>",
+		"To: Alice <alice@example.com>, Dropped <dropped@example.com>",
+		"Cc: Carol <Carol@example.com>",
+		"Bcc: hidden@example.com",
+		"Subject: Preserve test",
+		"",
+		"body",
+	}, "\r\n")
+
+	recipients := []string{"alice@example.com", "carol@example.com", "hidden@example.com"}
+	payload, err := PrepareGraphMIME([]byte(raw), Envelope{From: "test1@example.com", Recipients: recipients, Mode: EnvelopePreserve})
+	if err != nil {
+		t.Fatalf("PrepareGraphMIME() error = %v", err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage() error = %v", err)
+	}
+
+	if got := msg.Header.Get("To"); got != `"Alice" <alice@example.com>` {
+		t.Fatalf("To header = %q, want only envelope recipients", got)
+	}
+
+	if got := msg.Header.Get("Cc"); got != "Carol <Carol@example.com>" {
+		t.Fatalf("Cc header = %q, want original header", got)
+	}
+
+	if got := msg.Header.Get("Bcc"); got != "" {
+		t.Fatalf("Bcc header = %q, want empty", got)
+	}
+}
+
 func TestPrepareGraphMIMERejectsInvalidMultipart(t *testing.T) {
 	raw := strings.Join([]string{
 		"From: original@example.com",
@@ -84,15 +149,14 @@ func TestPrepareGraphMIMERejectsInvalidMultipart(t *testing.T) {
 		"unterminated multipart body",
 	}, "\r\n")
 
-	if _, err := prepareGraphMIME([]byte(raw), "test1@example.com", []string{"test1@example.com"}); err == nil {
-		t.Fatal("prepareGraphMIME() error = nil, want malformed multipart error")
+	if _, err := PrepareGraphMIME([]byte(raw), Envelope{From: "test1@example.com", Recipients: []string{"test1@example.com"}, Mode: EnvelopeOverride}); err == nil {
+		t.Fatal("PrepareGraphMIME() error = nil, want malformed multipart error")
 	}
 }
 
-func TestPrepareGraphMIMERejectsOversizedEncodedPayload(t *testing.T) {
-	bodyLen := maxGraphMIMEEncodedBytes
-	bodyLen = bodyLen - (bodyLen % 4) + 8
-	oversizedBody := strings.Repeat("a", bodyLen)
+func TestPrepareGraphMIMEAcceptsLargePayload(t *testing.T) {
+	// payloads beyond a single Graph request are split by the graph client
+	largeBody := strings.Repeat("a", 4*1024*1024)
 	raw := strings.Join([]string{
 		"From: original@example.com",
 		"To: old@example.com",
@@ -100,21 +164,16 @@ func TestPrepareGraphMIMERejectsOversizedEncodedPayload(t *testing.T) {
 		"MIME-Version: 1.0",
 		"Content-Type: text/plain; charset=utf-8",
 		"",
-		oversizedBody,
+		largeBody,
 	}, "\r\n")
 
-	_, err := prepareGraphMIME([]byte(raw), "test1@example.com", []string{"test1@example.com"})
-	if err == nil {
-		t.Fatal("prepareGraphMIME() error = nil, want size rejection")
-	}
-
-	if !strings.Contains(err.Error(), "exceeds limit") {
-		t.Fatalf("prepareGraphMIME() error = %v, want size limit failure", err)
+	payload, err := PrepareGraphMIME([]byte(raw), Envelope{From: "test1@example.com", Recipients: []string{"test1@example.com"}, Mode: EnvelopeOverride})
+	if err != nil {
+		t.Fatalf("PrepareGraphMIME() error = %v", err)
 	}
 
-	encodedLen := base64.StdEncoding.EncodedLen(len([]byte(raw)))
-	if encodedLen <= maxGraphMIMEEncodedBytes {
-		t.Fatalf("test setup invalid: encoded length %d did not exceed limit %d", encodedLen, maxGraphMIMEEncodedBytes)
+	if !strings.HasSuffix(string(payload), largeBody) {
+		t.Fatalf("payload did not preserve the message body")
 	}
 }
 
@@ -134,3 +193,36 @@ func TestNormalizeMailboxListParsesCommaSeparatedEnvValue(t *testing.T) {
 		t.Fatalf("normalizeMailboxList() = %v, want %v", got, want)
 	}
 }
+
+func TestPrepareGraphMIMEKeepsOriginalSender(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: root@printer01.local",
+		"To: alerts@example.com",
+		"Subject: Toner low",
+		"",
+		"body",
+	}, "\r\n")
+
+	payload, err := PrepareGraphMIME([]byte(raw), Envelope{
+		From:           "printers@example.com",
+		Recipients:     []string{"alerts@example.com"},
+		DisplayName:    "Printer 01",
+		OriginalSender: "root@printer01.local",
+		OriginalHeader: OriginalReplyTo,
+	})
+	if err != nil {
+		t.Fatalf("PrepareGraphMIME() error = %v", err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage() error = %v", err)
+	}
+
+	if got := msg.Header.Get("From"); got != `"Printer 01" <printers@example.com>` {
+		t.Errorf("From header = %q, want display name with rewritten sender", got)
+	}
+	if got := msg.Header.Get("Reply-To"); got != "root@printer01.local" {
+		t.Errorf("Reply-To header = %q, want original sender", got)
+	}
+}
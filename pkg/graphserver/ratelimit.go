@@ -0,0 +1,142 @@
+package graphserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit types, also used as the limit metric label
+const (
+	LimitGlobal = "global"
+	LimitSource = "source"
+	LimitSender = "sender"
+)
+
+// Rate is a token bucket rate allowing Count messages every Per, with bursts
+// of up to Count messages
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRate parses a rate in the form "count/duration" such as "100/1h" or
+// "10/m", where a duration without a number is a single unit. An empty spec
+// returns the zero Rate, which disables the limit.
+func ParseRate(spec string) (Rate, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return Rate{}, nil
+	}
+
+	count, per, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q: must be count/duration", spec)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: count must be a positive integer", spec)
+	}
+
+	per = strings.TrimSpace(per)
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: duration must be positive", spec)
+	}
+
+	return Rate{Count: n, Per: d}, nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a set of token buckets keyed by source, sender or a single global
+// key. A nil limiter allows everything.
+type limiter struct {
+	name string
+	rate Rate
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(name string, rate Rate) *limiter {
+	if rate.Count <= 0 {
+		return nil
+	}
+
+	return &limiter{
+		name:    name,
+		rate:    rate,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket for key, returning false if it is empty
+func (l *limiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Count), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return b.tokens
+	}
+
+	tokens := b.tokens + elapsed.Seconds()*float64(l.rate.Count)/l.rate.Per.Seconds()
+	return min(tokens, float64(l.rate.Count))
+}
+
+// sweep removes buckets that have refilled completely, so that keys that are
+// no longer seen do not accumulate
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.rate.Per {
+		return
+	}
+	l.swept = now
+
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.rate.Count) {
+			delete(l.buckets, key)
+		}
+	}
+}
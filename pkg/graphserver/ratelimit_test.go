@@ -0,0 +1,106 @@
+package graphserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Rate
+		wantErr bool
+	}{
+		{"", Rate{}, false},
+		{"100/1h", Rate{Count: 100, Per: time.Hour}, false},
+		{"10/m", Rate{Count: 10, Per: time.Minute}, false},
+		{" 5 / 30s ", Rate{Count: 5, Per: 30 * time.Second}, false},
+		{"100", Rate{}, true},
+		{"0/1m", Rate{}, true},
+		{"10/0s", Rate{}, true},
+		{"ten/1m", Rate{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(LimitSource, Rate{Count: 2, Per: time.Minute})
+	l.now = func() time.Time { return now }
+
+	for i := range 2 {
+		if !l.allow("10.0.0.1") {
+			t.Fatalf("allow() = false on message %d, want true", i+1)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatalf("allow() = true after burst, want false")
+	}
+	if !l.allow("10.0.0.2") {
+		t.Fatalf("allow() = false for a different key, want true")
+	}
+
+	// one token is refilled every 30 seconds
+	now = now.Add(30 * time.Second)
+	if !l.allow("10.0.0.1") {
+		t.Fatalf("allow() = false after refill, want true")
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatalf("allow() = true before next refill, want false")
+	}
+
+	// idle buckets are removed once full
+	now = now.Add(2 * time.Minute)
+	l.allow("10.0.0.3")
+	if _, ok := l.buckets["10.0.0.2"]; ok {
+		t.Errorf("idle bucket was not removed")
+	}
+}
+
+func TestNilLimiterAllows(t *testing.T) {
+	var l *limiter
+	if !l.allow("anything") {
+		t.Fatalf("nil limiter allow() = false, want true")
+	}
+	if newLimiter(LimitGlobal, Rate{}) != nil {
+		t.Fatalf("newLimiter() with zero rate is not nil")
+	}
+}
+
+func TestSessionSenderLimitCountsAcceptedSenders(t *testing.T) {
+	s := &Session{
+		tenants:        &tenantSet{fallback: &tenant{Tenant: Tenant{Name: DefaultTenant}}},
+		allowedSenders: []string{"allowed@example.com"},
+		senderLimit:    newLimiter(LimitSender, Rate{Count: 1, Per: time.Hour}),
+		sendDenied:     prometheus.NewCounter(prometheus.CounterOpts{Name: "denied"}),
+	}
+
+	// rejected senders do not take a token
+	for range 2 {
+		if err := s.Mail("denied@example.com", nil); err == nil {
+			t.Fatalf("Mail() from a sender that is not allowed succeeded")
+		}
+	}
+	if s.senderLimit.buckets["denied@example.com"] != nil {
+		t.Errorf("rejected sender was counted by the sender limit")
+	}
+
+	if err := s.Mail("allowed@example.com", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	if err := s.Mail("allowed@example.com", nil); err == nil {
+		t.Fatalf("Mail() over the sender limit succeeded")
+	}
+}
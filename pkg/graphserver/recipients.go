@@ -0,0 +1,149 @@
+package graphserver
+
+import (
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+)
+
+// reasons a recipient is denied, used as the reason metric label
+const (
+	recipientDenied     = "denied"
+	recipientNotAllowed = "not_allowed"
+	recipientExternal   = "external"
+)
+
+// RecipientPolicy restricts the recipients that matching clients may relay to.
+//
+// A policy applies to envelope senders matching Senders (wildcard patterns
+// such as "*@example.com") and clients within Sources (CIDR blocks, IP
+// addresses or hostnames). Either may be empty to match any sender or source.
+//
+// Recipients matching DenyRecipients are always refused. If any of
+// AllowDomains, AllowRecipients or InternalOnly are set, recipients must match
+// one of them, where InternalOnly allows the verified domains of the tenant the
+// message is sent with.
+type RecipientPolicy struct {
+	Senders         []string `mapstructure:"senders"`
+	Sources         []string `mapstructure:"sources"`
+	AllowDomains    []string `mapstructure:"allow_domains"`
+	AllowRecipients []string `mapstructure:"allow_recipients"`
+	DenyRecipients  []string `mapstructure:"deny_recipients"`
+	InternalOnly    bool     `mapstructure:"internal_only"`
+}
+
+type recipientPolicy struct {
+	RecipientPolicy
+	sources []netip.Prefix
+}
+
+func newRecipientPolicies(policies []RecipientPolicy) ([]*recipientPolicy, error) {
+	compiled := make([]*recipientPolicy, 0, len(policies))
+	for i, policy := range policies {
+		p := &recipientPolicy{
+			RecipientPolicy: RecipientPolicy{
+				Senders:         normalizePatterns(policy.Senders),
+				AllowDomains:    normalizePatterns(policy.AllowDomains),
+				AllowRecipients: normalizePatterns(policy.AllowRecipients),
+				DenyRecipients:  normalizePatterns(policy.DenyRecipients),
+				InternalOnly:    policy.InternalOnly,
+			},
+		}
+
+		for _, patterns := range [][]string{p.Senders, p.AllowDomains, p.AllowRecipients, p.DenyRecipients} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern %q in recipient policy %d: %w", pattern, i+1, err)
+				}
+			}
+		}
+
+		sources, err := parsePrefixes(policy.Sources)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sources in recipient policy %d: %w", i+1, err)
+		}
+		p.sources = sources
+
+		compiled = append(compiled, p)
+	}
+
+	return compiled, nil
+}
+
+// needsVerifiedDomains reports whether any policy is internal only
+func needsVerifiedDomains(policies []RecipientPolicy) bool {
+	return slices.ContainsFunc(policies, func(p RecipientPolicy) bool {
+		return p.InternalOnly
+	})
+}
+
+// selectRecipientPolicy returns the first policy matching sender and remote,
+// or nil if there is none
+func selectRecipientPolicy(policies []*recipientPolicy, sender, remote string) *recipientPolicy {
+	for _, p := range policies {
+		if len(p.Senders) > 0 && !matchPatterns(p.Senders, sender) {
+			continue
+		}
+
+		if len(p.sources) > 0 {
+			addr, err := parseRemoteAddr(remote)
+			if err != nil || !matchPrefixes(p.sources, addr) {
+				continue
+			}
+		}
+
+		return p
+	}
+
+	return nil
+}
+
+// check returns whether rcpt is allowed and if not, the reason why, where
+// internal are the verified domains of the tenant the message is sent with
+func (p *recipientPolicy) check(rcpt string, internal []string) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+
+	if matchPatterns(p.DenyRecipients, rcpt) {
+		return false, recipientDenied
+	}
+
+	if len(p.AllowDomains) == 0 && len(p.AllowRecipients) == 0 && !p.InternalOnly {
+		return true, ""
+	}
+
+	_, domain, _ := strings.Cut(rcpt, "@")
+	if matchPatterns(p.AllowRecipients, rcpt) || matchPatterns(p.AllowDomains, domain) || (p.InternalOnly && slices.Contains(internal, domain)) {
+		return true, ""
+	}
+
+	if p.InternalOnly && len(p.AllowDomains) == 0 && len(p.AllowRecipients) == 0 {
+		return false, recipientExternal
+	}
+
+	return false, recipientNotAllowed
+}
+
+func normalizePatterns(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			normalized = append(normalized, pattern)
+		}
+	}
+
+	return normalized
+}
+
+func matchPatterns(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
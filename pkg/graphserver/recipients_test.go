@@ -0,0 +1,75 @@
+package graphserver
+
+import "testing"
+
+func TestRecipientPolicies(t *testing.T) {
+	policies, err := newRecipientPolicies([]RecipientPolicy{
+		{
+			Senders:         []string{"*@finance.example.com"},
+			AllowDomains:    []string{"bank.example.net", "*.example.com"},
+			AllowRecipients: []string{"Auditor@Partner.example.org"},
+		},
+		{
+			Sources:        []string{"10.0.0.0/8"},
+			DenyRecipients: []string{"*@competitor.example"},
+			InternalOnly:   true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientPolicies() error = %v", err)
+	}
+	internal := []string{"example.com"}
+
+	tests := []struct {
+		sender, remote, rcpt string
+		allowed              bool
+		reason               string
+	}{
+		{"ap@finance.example.com", "192.0.2.1:25", "payments@bank.example.net", true, ""},
+		{"ap@finance.example.com", "192.0.2.1:25", "user@sub.example.com", true, ""},
+		{"ap@finance.example.com", "192.0.2.1:25", "auditor@partner.example.org", true, ""},
+		{"ap@finance.example.com", "192.0.2.1:25", "someone@gmail.example", false, recipientNotAllowed},
+		{"printer@example.com", "10.1.1.1:25", "staff@example.com", true, ""},
+		{"printer@example.com", "10.1.1.1:25", "someone@gmail.example", false, recipientExternal},
+		{"printer@example.com", "10.1.1.1:25", "ceo@competitor.example", false, recipientDenied},
+		{"printer@example.com", "192.0.2.1:25", "anyone@anywhere.example", true, ""},
+		{"ap@finance.example.com", "192.0.2.1:25", "staff@example.com", false, recipientNotAllowed},
+	}
+
+	for _, tt := range tests {
+		policy := selectRecipientPolicy(policies, tt.sender, tt.remote)
+		allowed, reason := policy.check(tt.rcpt, internal)
+		if allowed != tt.allowed || reason != tt.reason {
+			t.Errorf("check(%q) for %q from %q = %v, %q, want %v, %q", tt.rcpt, tt.sender, tt.remote, allowed, reason, tt.allowed, tt.reason)
+		}
+	}
+}
+
+func TestInternalOnlyTenantDomains(t *testing.T) {
+	policies, err := newRecipientPolicies([]RecipientPolicy{{InternalOnly: true}})
+	if err != nil {
+		t.Fatalf("newRecipientPolicies() error = %v", err)
+	}
+
+	// each tenant only allows its own verified domains
+	contoso := []string{"contoso.com"}
+	fabrikam := []string{"fabrikam.com", "fabrikam.net"}
+
+	tests := []struct {
+		rcpt    string
+		domains []string
+		allowed bool
+	}{
+		{"staff@contoso.com", contoso, true},
+		{"staff@fabrikam.com", contoso, false},
+		{"staff@fabrikam.net", fabrikam, true},
+		{"staff@contoso.com", fabrikam, false},
+		{"staff@contoso.com", nil, false},
+	}
+
+	for _, tt := range tests {
+		if allowed, _ := policies[0].check(tt.rcpt, tt.domains); allowed != tt.allowed {
+			t.Errorf("check(%q) with domains %v = %v, want %v", tt.rcpt, tt.domains, allowed, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package graphserver
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Headers the original sender is kept in when rewritten
+const (
+	// OriginalReplyTo sets Reply-To to the original sender, unless the message
+	// already has a Reply-To header
+	OriginalReplyTo = "reply-to"
+	// OriginalHeader adds an X-Original-Sender header
+	OriginalHeader = "header"
+)
+
+// RewriteRule maps envelope senders matching Match to the mailbox Sender.
+//
+// Match may be an exact address, a wildcard pattern such as "*@printer01.local"
+// or "root@*", or a regular expression between slashes such as
+// "/^scanner-(\d+)@.*$/", in which case Sender may refer to capture groups as
+// "$1". Matching is case-insensitive.
+type RewriteRule struct {
+	Match       string `mapstructure:"match"`
+	Sender      string `mapstructure:"sender"`
+	DisplayName string `mapstructure:"display_name"`
+	Original    string `mapstructure:"original"`
+}
+
+type rewriteRule struct {
+	RewriteRule
+	re   *regexp.Regexp
+	glob bool
+}
+
+// rewriter applies the first matching rewrite rule to an envelope sender
+type rewriter struct {
+	rules []rewriteRule
+}
+
+func newRewriter(rules []RewriteRule) (*rewriter, error) {
+	r := &rewriter{rules: make([]rewriteRule, 0, len(rules))}
+	for _, rule := range rules {
+		rule.Match = strings.TrimSpace(rule.Match)
+		rule.Sender = strings.TrimSpace(rule.Sender)
+		rule.Original = strings.ToLower(strings.TrimSpace(rule.Original))
+		compiled := rewriteRule{RewriteRule: rule}
+
+		if rule.Match == "" || rule.Sender == "" {
+			return nil, fmt.Errorf("rewrite rule must have a match and sender")
+		}
+
+		switch rule.Original {
+		case "", OriginalReplyTo, OriginalHeader:
+		default:
+			return nil, fmt.Errorf("invalid original sender header %q for rewrite rule %q", rule.Original, rule.Match)
+		}
+
+		switch {
+		case len(rule.Match) > 1 && strings.HasPrefix(rule.Match, "/") && strings.HasSuffix(rule.Match, "/"):
+			re, err := regexp.Compile("(?i)" + rule.Match[1:len(rule.Match)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite rule %q: %w", rule.Match, err)
+			}
+			compiled.re = re
+		case strings.ContainsAny(rule.Match, "*?["):
+			compiled.Match = strings.ToLower(rule.Match)
+			if _, err := path.Match(compiled.Match, ""); err != nil {
+				return nil, fmt.Errorf("invalid rewrite rule %q: %w", rule.Match, err)
+			}
+			compiled.glob = true
+		default:
+			compiled.Match = strings.ToLower(rule.Match)
+		}
+
+		// senders using capture groups can only be checked once expanded
+		if compiled.re == nil || !strings.Contains(rule.Sender, "$") {
+			normalized, err := normalizeMailbox(rule.Sender)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sender %q for rewrite rule %q: %w", rule.Sender, rule.Match, err)
+			}
+			compiled.Sender = normalized
+		}
+
+		r.rules = append(r.rules, compiled)
+	}
+
+	return r, nil
+}
+
+// rewrite returns the rule matching sender and the rewritten sender, or nil
+// if no rule matched
+func (r *rewriter) rewrite(sender string) (*RewriteRule, string, error) {
+	if r == nil {
+		return nil, sender, nil
+	}
+
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	for i := range r.rules {
+		rule := &r.rules[i]
+
+		switch {
+		case rule.re != nil:
+			match := rule.re.FindStringSubmatchIndex(sender)
+			if match == nil {
+				continue
+			}
+			expanded := string(rule.re.ExpandString(nil, rule.Sender, sender, match))
+			normalized, err := normalizeMailbox(expanded)
+			if err != nil {
+				return nil, sender, fmt.Errorf("rewrite rule %q produced invalid sender %q: %w", rule.Match, expanded, err)
+			}
+			return &rule.RewriteRule, normalized, nil
+		case rule.glob:
+			if ok, _ := path.Match(rule.Match, sender); !ok {
+				continue
+			}
+		default:
+			if rule.Match != sender {
+				continue
+			}
+		}
+
+		return &rule.RewriteRule, rule.Sender, nil
+	}
+
+	return nil, sender, nil
+}
+
+// setOriginalSender keeps the original envelope sender in header
+func setOriginalSender(header mail.Header, mode, original string) {
+	switch mode {
+	case OriginalReplyTo:
+		if len(header["Reply-To"]) == 0 {
+			setHeader(header, "Reply-To", original)
+		}
+	case OriginalHeader:
+		setHeader(header, "X-Original-Sender", original)
+	}
+}
@@ -0,0 +1,54 @@
+package graphserver
+
+import "testing"
+
+func TestRewriterRewrite(t *testing.T) {
+	r, err := newRewriter([]RewriteRule{
+		{Match: "Root@Host01", Sender: "alerts@example.com"},
+		{Match: "*@printer01.local", Sender: "printers@example.com", DisplayName: "Printer 01"},
+		{Match: `/^scanner-(\d+)@.*\.local$/`, Sender: "scanner$1@example.com"},
+		{Match: "root@*", Sender: "root@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("newRewriter() error = %v", err)
+	}
+
+	tests := []struct {
+		sender string
+		want   string
+		rule   string
+	}{
+		{"root@host01", "alerts@example.com", "root@host01"},
+		{"Scan@Printer01.local", "printers@example.com", "*@printer01.local"},
+		{"scanner-7@floor2.local", "scanner7@example.com", `/^scanner-(\d+)@.*\.local$/`},
+		{"root@host02", "root@example.com", "root@*"},
+		{"user@example.com", "user@example.com", ""},
+	}
+
+	for _, tt := range tests {
+		rule, got, err := r.rewrite(tt.sender)
+		if err != nil {
+			t.Errorf("rewrite(%q) error = %v", tt.sender, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.sender, got, tt.want)
+		}
+		if (rule == nil && tt.rule != "") || (rule != nil && rule.Match != tt.rule) {
+			t.Errorf("rewrite(%q) matched rule %v, want %q", tt.sender, rule, tt.rule)
+		}
+	}
+}
+
+func TestNewRewriterRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []RewriteRule{
+		{Match: "root@host", Sender: "not an address"},
+		{Match: "/(unclosed/", Sender: "alerts@example.com"},
+		{Match: "root@host", Sender: "alerts@example.com", Original: "subject"},
+		{Match: "", Sender: "alerts@example.com"},
+	} {
+		if _, err := newRewriter([]RewriteRule{rule}); err == nil {
+			t.Errorf("newRewriter(%+v) error = nil, want error", rule)
+		}
+	}
+}
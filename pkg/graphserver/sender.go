@@ -0,0 +1,56 @@
+package graphserver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+)
+
+// Sender delivers a prepared MIME message from the envelope sender to
+// recipients, sending as user where the service sends from a mailbox.
+//
+// graphclient.Client is the default implementation, while relayclient, maildir
+// and webhook provide alternatives. Errors that will fail again if retried
+// should implement Permanent() bool.
+type Sender interface {
+	SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error
+}
+
+// validator is implemented by senders that can check their credentials
+type validator interface {
+	Validate(ctx context.Context) error
+}
+
+// pinger is implemented by senders that can check they are able to make
+// requests
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// domainLister is implemented by senders that know the domains they send for
+type domainLister interface {
+	VerifiedDomains(ctx context.Context) ([]string, error)
+}
+
+// userChecker is implemented by senders that can check a user they send as
+// exists
+type userChecker interface {
+	CheckUser(ctx context.Context, user string) error
+}
+
+// hoster is implemented by senders that deliver to a remote host, which is
+// reported as the Remote-MTA in bounces
+type hoster interface {
+	Host() string
+}
+
+// permanent reports whether a send error will fail again if retried
+func permanent(err error) bool {
+	if errors.Is(err, graphclient.ErrMessageTooLarge) {
+		return true
+	}
+
+	var p interface{ Permanent() bool }
+	return errors.As(err, &p) && p.Permanent()
+}
@@ -0,0 +1,147 @@
+package graphserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/maildir"
+	"github.com/tombull/office365-smtp-proxy/pkg/relayclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
+	"github.com/tombull/office365-smtp-proxy/pkg/webhook"
+)
+
+func TestNewBackendDeliversWithSender(t *testing.T) {
+	dir := t.TempDir()
+	m, err := maildir.New(dir)
+	if err != nil {
+		t.Fatalf("maildir.New() error = %v", err)
+	}
+
+	b, err := NewBackend(m, WithPrometheusRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+
+	if err := b.Deliver(context.Background(), &spool.Message{
+		From:       "sender@example.com",
+		Recipients: []string{"rcpt@example.com"},
+		MIME:       []byte("Subject: test\r\n\r\nbody\r\n"),
+	}); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("maildir new = %d entries (%v), want 1", len(entries), err)
+	}
+
+	// senders without credentials are not validated
+	if err := b.ValidateCredentials(context.Background()); err != nil {
+		t.Errorf("ValidateCredentials() error = %v, want nil", err)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{graphclient.ErrMessageTooLarge, true},
+		{&relayclient.ReplyError{Code: 550}, true},
+		{fmt.Errorf("wrapped: %w", &relayclient.ReplyError{Code: 451}), false},
+		{&webhook.StatusError{StatusCode: 400}, true},
+		{&webhook.StatusError{StatusCode: 503}, false},
+		{errors.New("connection reset"), false},
+	}
+
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("permanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// userSender is a Sender that knows a fixed set of users
+type userSender struct {
+	testSender
+	users []string
+}
+
+func (s *userSender) CheckUser(ctx context.Context, user string) error {
+	for _, u := range s.users {
+		if u == user {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %q not found", user)
+}
+
+func TestValidateSendUsers(t *testing.T) {
+	sender := &userSender{users: []string{"relay@example.com", "scanners@example.com"}}
+
+	b, err := NewBackend(sender,
+		WithSendUser("relay@example.com"),
+		WithSendUserRoutes([]SendUserRoute{{Senders: []string{"*@scan.example.com"}, GraphUser: "scanners@example.com"}}),
+		WithPrometheusRegistry(prometheus.NewRegistry()),
+	)
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+	if err := b.ValidateSendUsers(context.Background()); err != nil {
+		t.Errorf("ValidateSendUsers() error = %v, want nil", err)
+	}
+
+	b, err = NewBackend(sender,
+		WithSendUser("missing@example.com"),
+		WithPrometheusRegistry(prometheus.NewRegistry()),
+	)
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+	if err := b.ValidateSendUsers(context.Background()); err == nil {
+		t.Errorf("ValidateSendUsers() with unknown send user error = nil, want error")
+	}
+}
+
+// checkSender is a Sender whose credential validates but whose requests may
+// fail, as when a cached token is no longer accepted
+type checkSender struct {
+	testSender
+	pingErr error
+}
+
+func (s *checkSender) Validate(ctx context.Context) error {
+	return nil
+}
+
+func (s *checkSender) Ping(ctx context.Context) error {
+	return s.pingErr
+}
+
+func TestCheckGraph(t *testing.T) {
+	sender := &checkSender{pingErr: errors.New("could not reach graph")}
+
+	b, err := NewBackend(sender, WithPrometheusRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+
+	// readiness is based on a request rather than the credential
+	if err := b.ValidateCredentials(context.Background()); err != nil {
+		t.Errorf("ValidateCredentials() error = %v, want nil", err)
+	}
+	if err := b.CheckGraph(context.Background()); err == nil {
+		t.Errorf("CheckGraph() with failing requests error = nil, want error")
+	}
+
+	sender.pingErr = nil
+	if err := b.CheckGraph(context.Background()); err != nil {
+		t.Errorf("CheckGraph() error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,49 @@
+package graphserver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SendUserRoute sends messages from envelope senders matching Senders (exact
+// addresses or wildcard patterns such as "*@alerts.example.com") as the Graph
+// user GraphUser, which may be a user ID or user principal name.
+type SendUserRoute struct {
+	Senders   []string `mapstructure:"senders"`
+	GraphUser string   `mapstructure:"graph_user"`
+}
+
+func newSendUserRoutes(routes []SendUserRoute) ([]SendUserRoute, error) {
+	normalized := make([]SendUserRoute, 0, len(routes))
+	for i, route := range routes {
+		route.Senders = normalizePatterns(route.Senders)
+		route.GraphUser = strings.TrimSpace(route.GraphUser)
+
+		if len(route.Senders) == 0 || route.GraphUser == "" {
+			return nil, fmt.Errorf("send user route %d must have senders and a graph user", i+1)
+		}
+
+		for _, pattern := range route.Senders {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q in send user route %d: %w", pattern, i+1, err)
+			}
+		}
+
+		normalized = append(normalized, route)
+	}
+
+	return normalized, nil
+}
+
+// routeSendUser returns the Graph user of the first route matching sender, or
+// "" if none match
+func routeSendUser(routes []SendUserRoute, sender string) string {
+	for _, route := range routes {
+		if matchPatterns(route.Senders, sender) {
+			return route.GraphUser
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,29 @@
+package graphserver
+
+import "testing"
+
+func TestRouteSendUser(t *testing.T) {
+	routes, err := newSendUserRoutes([]SendUserRoute{
+		{Senders: []string{"*@Alerts.example.com"}, GraphUser: "alerts-relay@example.com"},
+		{Senders: []string{"printer-finance@example.com", "scanner-finance@example.com"}, GraphUser: "finance@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("newSendUserRoutes() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"disk@alerts.example.com":     "alerts-relay@example.com",
+		"scanner-finance@example.com": "finance@example.com",
+		"user@example.com":            "",
+	}
+
+	for sender, want := range tests {
+		if got := routeSendUser(routes, sender); got != want {
+			t.Errorf("routeSendUser(%q) = %q, want %q", sender, got, want)
+		}
+	}
+
+	if _, err := newSendUserRoutes([]SendUserRoute{{Senders: []string{"*@example.com"}}}); err == nil {
+		t.Errorf("newSendUserRoutes() without graph user error = nil, want error")
+	}
+}
@@ -5,44 +5,113 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+	"github.com/tombull/office365-smtp-proxy/pkg/spool"
 )
 
 type Session struct {
 	from           string
 	recipients     []string
 	graphUser      string
-	client         *graphclient.Client
+	tenants        *tenantSet
+	tenant         *tenant
+	router         *router
+	drainer        *drainer
+	conn           net.Conn
+	readTimeout    time.Duration
+	route          string
 	logger         Logger
 	logLevel       Level
 	allowedSenders []string
 	sendUser       string
+	sendUserRoutes []SendUserRoute
+	spool          *spool.Spool
+	users          map[string]*authUser
+	user           *authUser
+	relay          string
+	envelopeMode   string
+	trusted        bool
+	listener       string
+	requireTLS     bool
+	tls            bool
+	tlsVersion     string
+	tlsCipher      string
+	rewriter       *rewriter
+	rewrite        *RewriteRule
+	originalFrom   string
+	recipientRules []*recipientPolicy
+	recipientRule  *recipientPolicy
+	source         string
+	globalLimit    *limiter
+	sourceLimit    *limiter
+	senderLimit    *limiter
 	helo           string
 	remote         string
 	errors         []error
 	status         string
 
-	sendErrors prometheus.Counter
-	sendDenied prometheus.Counter
+	sendErrors  prometheus.Counter
+	sendDenied  prometheus.Counter
+	rateLimited *prometheus.CounterVec
+	rcptDenied  *prometheus.CounterVec
+	tlsTotal    *prometheus.CounterVec
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	if s.client == nil {
+	if s.tenants == nil {
 		return s.fail(errors.New("graph client not initialised"), false)
 	}
 
+	if s.drainer.closed() {
+		s.fail(errors.New("shutting down"), false)
+		return errShuttingDown
+	}
+
+	if s.requireTLS && !s.tls {
+		s.fail(errors.New("TLS required"), true)
+		return errTLSRequired
+	}
+
+	// check that the client may relay at all
+	if s.user == nil && s.users != nil && (s.relay == RelayDisabled || !s.trusted) {
+		s.fail(errors.New("authentication required"), true)
+		return errAuthRequired
+	}
+
+	if err := s.rateLimit(s.sourceLimit, s.source); err != nil {
+		return err
+	}
+
+	// rewrite the sender before it is checked, so senders that are not valid
+	// mailboxes may be mapped to one
+	rule, rewritten, err := s.rewriter.rewrite(from)
+	if err != nil {
+		return s.fail(err, true)
+	}
+	s.rewrite = rule
+	s.originalFrom = ""
+	if rule != nil {
+		s.originalFrom = strings.ToLower(strings.TrimSpace(from))
+		from = rewritten
+	}
+
 	normalizedFrom, err := normalizeMailbox(from)
 	if err != nil {
 		return s.fail(fmt.Errorf("invalid MAIL FROM address %q: %w", from, err), true)
 	}
 	s.from = normalizedFrom
 	s.graphUser = s.from
-	if s.sendUser != "" {
+	if graphUser := routeSendUser(s.sendUserRoutes, s.from); graphUser != "" {
+		s.graphUser = graphUser
+	} else if s.sendUser != "" {
 		s.graphUser = s.sendUser
 	}
 
@@ -53,6 +122,38 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 		}
 	}
 
+	// check that the authenticated user may send as sender
+	if s.user != nil && len(s.user.senders) > 0 {
+		if _, found := slices.BinarySearch(s.user.senders, s.from); !found {
+			return s.fail(fmt.Errorf("sender %q not allowed for user %q", s.from, s.user.name), true)
+		}
+	}
+
+	// select the Graph credential to send with
+	user := ""
+	if s.user != nil {
+		user = s.user.name
+	}
+	if s.tenant = s.tenants.route(user, s.from); s.tenant == nil {
+		return s.fail(&smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Sender %s does not belong to a configured tenant", s.from),
+		}, true)
+	}
+
+	s.recipientRule = selectRecipientPolicy(s.recipientRules, s.from, s.remote)
+
+	// only senders that have been accepted are counted, so rejected senders do
+	// not use up the limit of a sender they are not allowed to send as
+	if err := s.rateLimit(s.senderLimit, s.from); err != nil {
+		return err
+	}
+
+	if s.tlsTotal != nil {
+		s.tlsTotal.WithLabelValues(s.tlsVersion, s.tlsCipher).Inc()
+	}
+
 	s.recipients = s.recipients[:0]
 	return nil
 }
@@ -63,6 +164,18 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		return s.fail(fmt.Errorf("invalid RCPT TO address %q: %w", to, err), true)
 	}
 
+	// check that the recipient is allowed for this sender and source
+	if ok, reason := s.recipientRule.check(normalizedTo, s.tenant.domains); !ok {
+		if s.rcptDenied != nil {
+			s.rcptDenied.WithLabelValues(reason).Inc()
+		}
+		return s.fail(&smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Recipient %s not allowed (%s)", normalizedTo, reason),
+		}, true)
+	}
+
 	s.recipients = append(s.recipients, normalizedTo)
 
 	return nil
@@ -77,17 +190,100 @@ func (s *Session) Data(r io.Reader) error {
 		return s.fail(errors.New("message missing RCPT TO recipients"), true)
 	}
 
+	// messages being received when shutdown starts are allowed to finish
+	if !s.drainer.begin() {
+		s.fail(errors.New("shutting down"), false)
+		return errShuttingDown
+	}
+	defer s.drainer.end()
+
+	if s.readTimeout > 0 && s.conn != nil {
+		r = &deadlineReader{r: r, conn: s.conn, timeout: s.readTimeout}
+		defer s.conn.SetReadDeadline(time.Time{})
+	}
+
 	rawMessage, err := io.ReadAll(r)
 	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.fail(fmt.Errorf("could not read message data: %w", err), false)
+			return errDataTimeout
+		}
 		return s.fail(fmt.Errorf("could not read message data: %w", err), false)
 	}
 
-	payload, err := prepareGraphMIME(rawMessage, s.from, s.recipients)
+	env := Envelope{
+		From:       s.from,
+		Recipients: s.recipients,
+		Mode:       s.envelopeMode,
+	}
+	if s.rewrite != nil {
+		env.DisplayName = s.rewrite.DisplayName
+		env.OriginalSender = s.originalFrom
+		env.OriginalHeader = s.rewrite.Original
+	}
+
+	payload, err := PrepareGraphMIME(rawMessage, env)
 	if err != nil {
 		return s.fail(fmt.Errorf("rejected MIME message: %w", err), true)
 	}
 
-	if err := s.client.SendMime(context.Background(), s.graphUser, s.from, payload); err != nil {
+	// the global limit protects the Graph app registration, so only messages
+	// about to be submitted are counted
+	if err := s.rateLimit(s.globalLimit, LimitGlobal); err != nil {
+		return err
+	}
+
+	if s.spool != nil {
+		if err := s.spool.Enqueue(&spool.Message{
+			GraphUser:  s.graphUser,
+			Tenant:     s.tenant.Name,
+			From:       s.from,
+			Recipients: append([]string(nil), s.recipients...),
+			MIME:       payload,
+		}); err != nil {
+			return s.fail(fmt.Errorf("could not spool message: %w", err), false)
+		}
+
+		s.status = "message queued"
+		if s.logLevel < LevelInfo {
+			s.logLevel = LevelInfo
+		}
+
+		return nil
+	}
+
+	route, err := s.router.send(s.drainer.context(), s.tenant, s.graphUser, s.from, s.recipients, payload)
+	s.route = route
+	if err != nil {
+		// sends cancelled by shutdown are temporary failures
+		if s.drainer.context().Err() != nil {
+			s.fail(fmt.Errorf("send aborted on shutdown: %w", err), false)
+			return errShuttingDown
+		}
+		if errors.Is(err, errSendQueueTimeout) {
+			return s.fail(errSendQueueTimeout, false)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return s.fail(&smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 4, 7},
+				Message:      "Timed out sending message, try again later",
+			}, false)
+		}
+		if errors.Is(err, graphclient.ErrMessageTooLarge) {
+			return s.fail(&smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      err.Error(),
+			}, true)
+		}
+		if permanent(err) {
+			return s.fail(&smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+				Message:      err.Error(),
+			}, false)
+		}
 		return s.fail(fmt.Errorf("error sending MIME message: %w", err), false)
 	}
 
@@ -102,19 +298,31 @@ func (s *Session) Data(r io.Reader) error {
 func (s *Session) Reset() {
 	if s.logger != nil {
 		to := strings.Join(s.recipients, ",")
+		user := ""
+		if s.user != nil {
+			user = s.user.name
+		}
+		tenant := ""
+		if s.tenant != nil {
+			tenant = s.tenant.Name
+		}
 		switch s.logLevel {
 		case LevelError:
-			s.logger.Error("session ended", "errors", s.errors, "from", s.from, "graph_user", s.graphUser, "to", to)
+			s.logger.Error("session ended", "errors", s.errors, "from", s.from, "graph_user", s.graphUser, "to", to, "user", user, "tenant", tenant, "route", s.route, "listener", s.listener, "tls_version", s.tlsVersion, "tls_cipher", s.tlsCipher, "original_from", s.originalFrom)
 		case LevelInfo:
-			s.logger.Info("session ended", "status", s.status, "from", s.from, "graph_user", s.graphUser, "to", to)
+			s.logger.Info("session ended", "status", s.status, "from", s.from, "graph_user", s.graphUser, "to", to, "user", user, "tenant", tenant, "route", s.route, "listener", s.listener, "tls_version", s.tlsVersion, "tls_cipher", s.tlsCipher, "original_from", s.originalFrom)
 		case LevelWarn:
-			s.logger.Warn("session ended", "status", s.status, "from", s.from, "graph_user", s.graphUser, "to", to)
+			s.logger.Warn("session ended", "status", s.status, "from", s.from, "graph_user", s.graphUser, "to", to, "user", user, "tenant", tenant, "route", s.route, "listener", s.listener, "tls_version", s.tlsVersion, "tls_cipher", s.tlsCipher, "original_from", s.originalFrom)
 		}
 	}
 
 	s.from = ""
+	s.originalFrom = ""
+	s.rewrite = nil
 	s.recipients = s.recipients[:0]
 	s.graphUser = ""
+	s.tenant = nil
+	s.route = ""
 	s.errors = s.errors[:0]
 	s.status = ""
 	s.logLevel = LevelInfo
@@ -124,6 +332,24 @@ func (s *Session) Logout() error {
 	return nil
 }
 
+// rateLimit takes a token for key from l, deferring the message with a
+// temporary failure if the limit has been exceeded
+func (s *Session) rateLimit(l *limiter, key string) error {
+	if l.allow(key) {
+		return nil
+	}
+
+	if s.rateLimited != nil {
+		s.rateLimited.WithLabelValues(l.name).Inc()
+	}
+
+	return s.fail(&smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      fmt.Sprintf("%s rate limit of %s exceeded, try again later", l.name, l.rate),
+	}, true)
+}
+
 func (s *Session) fail(err error, denied bool) error {
 	s.errors = append(s.errors, err)
 	s.logLevel = LevelError
@@ -0,0 +1,159 @@
+package graphserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// reasons a source is rejected, used as the reason metric label
+const (
+	sourceDenied     = "denied"
+	sourceNotAllowed = "not_allowed"
+	sourceInvalid    = "invalid_address"
+)
+
+// lookupNetIP resolves hostnames in source lists and is replaced in tests
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// sourcePolicy decides whether a remote address may relay without
+// authenticating. Denied prefixes take precedence over allowed prefixes and an
+// empty allow list allows every source that is not denied.
+type sourcePolicy struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newSourcePolicy(allow, deny []string) (*sourcePolicy, error) {
+	allowed, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed sources: %w", err)
+	}
+
+	denied, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied sources: %w", err)
+	}
+
+	return &sourcePolicy{allow: allowed, deny: denied}, nil
+}
+
+// check returns whether the remote address is trusted and if not, the reason why
+func (p *sourcePolicy) check(remote string) (bool, string) {
+	if len(p.allow) == 0 && len(p.deny) == 0 {
+		return true, ""
+	}
+
+	addr, err := parseRemoteAddr(remote)
+	if err != nil {
+		return false, sourceInvalid
+	}
+
+	if matchPrefixes(p.deny, addr) {
+		return false, sourceDenied
+	}
+
+	if len(p.allow) > 0 && !matchPrefixes(p.allow, addr) {
+		return false, sourceNotAllowed
+	}
+
+	return true, ""
+}
+
+// checkRelay returns whether the remote address may relay without
+// authenticating as check does, except that when SMTP AUTH is enabled an empty
+// allow list trusts nobody, so that enabling AUTH cannot leave an open relay
+func (p *sourcePolicy) checkRelay(remote string, auth bool) (bool, string) {
+	trusted, reason := p.check(remote)
+	if trusted && auth && len(p.allow) == 0 {
+		return false, sourceNotAllowed
+	}
+
+	return trusted, reason
+}
+
+// parsePrefixes converts a list of CIDR blocks, IP addresses and hostnames
+// into prefixes. Hostnames are resolved once, so changes to DNS are not seen
+// until restart.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+			}
+			prefixes = append(prefixes, unmapPrefix(prefix.Masked()))
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(value); err == nil {
+			addr = addr.Unmap().WithZone("")
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		addrs, err := lookupNetIP(context.Background(), "ip", value)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %q: %w", value, err)
+		}
+		for _, addr := range addrs {
+			addr = addr.Unmap().WithZone("")
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return prefixes, nil
+}
+
+// unmapPrefix converts an IPv4-mapped IPv6 prefix such as ::ffff:10.0.0.0/104
+// to the equivalent IPv4 prefix so that it matches unmapped addresses
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if !addr.Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+}
+
+func parseRemoteAddr(remote string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap().WithZone(""), nil
+}
+
+// sourceKey returns the remote IP address used to key per-source limits
+func sourceKey(remote string) string {
+	addr, err := parseRemoteAddr(remote)
+	if err != nil {
+		return remote
+	}
+
+	return addr.String()
+}
+
+func matchPrefixes(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,92 @@
+package graphserver
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestSourcePolicyCheck(t *testing.T) {
+	lookup := lookupNetIP
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.50")}, nil
+	}
+	t.Cleanup(func() { lookupNetIP = lookup })
+
+	policy, err := newSourcePolicy(
+		[]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.10", "printer.example.com"},
+		[]string{"10.9.0.0/16"},
+	)
+	if err != nil {
+		t.Fatalf("newSourcePolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		remote  string
+		trusted bool
+		reason  string
+	}{
+		{"10.1.2.3:25", true, ""},
+		{"[::ffff:10.1.2.3]:25", true, ""},
+		{"[2001:0db8:0000::0001]:25", true, ""},
+		{"[2001:db8::1%eth0]:25", true, ""},
+		{"192.168.1.10:1234", true, ""},
+		{"192.0.2.50:1234", true, ""},
+		{"10.9.1.1:25", false, sourceDenied},
+		{"192.168.1.11:25", false, sourceNotAllowed},
+		{"[2001:db9::1]:25", false, sourceNotAllowed},
+		{"pipe", false, sourceInvalid},
+	}
+
+	for _, tt := range tests {
+		trusted, reason := policy.check(tt.remote)
+		if trusted != tt.trusted || reason != tt.reason {
+			t.Errorf("check(%q) = %v, %q, want %v, %q", tt.remote, trusted, reason, tt.trusted, tt.reason)
+		}
+	}
+}
+
+func TestSourcePolicyDenyOnly(t *testing.T) {
+	policy, err := newSourcePolicy(nil, []string{"::ffff:203.0.113.0/120"})
+	if err != nil {
+		t.Fatalf("newSourcePolicy() error = %v", err)
+	}
+
+	if trusted, _ := policy.check("198.51.100.1:25"); !trusted {
+		t.Errorf("check() did not trust source outside deny list")
+	}
+
+	if trusted, reason := policy.check("203.0.113.9:25"); trusted || reason != sourceDenied {
+		t.Errorf("check() = %v, %q, want denied", trusted, reason)
+	}
+}
+
+func TestSourcePolicyCheckRelay(t *testing.T) {
+	policy, err := newSourcePolicy(nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatalf("newSourcePolicy() error = %v", err)
+	}
+
+	if trusted, _ := policy.checkRelay("198.51.100.1:25", false); !trusted {
+		t.Errorf("checkRelay() without AUTH did not trust source outside deny list")
+	}
+
+	// with AUTH enabled an empty allow list must not be an open relay
+	if trusted, reason := policy.checkRelay("198.51.100.1:25", true); trusted || reason != sourceNotAllowed {
+		t.Errorf("checkRelay() with AUTH = %v, %q, want not allowed", trusted, reason)
+	}
+
+	policy, err = newSourcePolicy([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("newSourcePolicy() error = %v", err)
+	}
+	if trusted, _ := policy.checkRelay("10.1.2.3:25", true); !trusted {
+		t.Errorf("checkRelay() with AUTH did not trust allowed source")
+	}
+}
+
+func TestNewSourcePolicyRejectsInvalidCIDR(t *testing.T) {
+	if _, err := newSourcePolicy([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatalf("newSourcePolicy() error = nil, want error")
+	}
+}
@@ -0,0 +1,145 @@
+package graphserver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+)
+
+// DefaultTenant is the name of the tenant using the credential passed to
+// NewGraphBackend
+const DefaultTenant = "default"
+
+// Tenant is a named Graph credential, such as the app registration of a
+// subsidiary with its own Entra tenant.
+//
+// Messages from SMTP AUTH users listed in Users, or otherwise from envelope
+// senders with a domain matching Domains (exact domains or wildcard patterns
+// such as "*.example.com"), are sent using Credential, or Sender if it is set.
+type Tenant struct {
+	Name       string
+	Credential graphclient.ClientOption
+	Sender     Sender
+	Domains    []string
+	Users      []string
+}
+
+type tenant struct {
+	Tenant
+	sender Sender
+
+	// domains are the verified domains of the tenant, which are only fetched
+	// for internal only recipient policies
+	domains []string
+
+	// metrics
+	sent   prometheus.Counter
+	errors prometheus.Counter
+}
+
+// send sends a message through the sender of the tenant
+func (t *tenant) send(ctx context.Context, graphUser, from string, recipients []string, mime []byte) error {
+	if err := t.sender.SendMime(ctx, graphUser, from, recipients, mime); err != nil {
+		t.errors.Inc()
+		return err
+	}
+
+	t.sent.Inc()
+	return nil
+}
+
+// tenantSet selects the tenant a message is sent with
+type tenantSet struct {
+	tenants  []*tenant
+	fallback *tenant
+}
+
+// newTenantSet returns the tenants using cred or sender, which may both be nil
+// if there are named tenants, as the default
+func newTenantSet(cred graphclient.ClientOption, sender Sender, tenants []Tenant) (*tenantSet, error) {
+	set := &tenantSet{tenants: make([]*tenant, 0, len(tenants)+1)}
+	if cred != nil || sender != nil {
+		set.fallback = &tenant{Tenant: Tenant{Name: DefaultTenant, Credential: cred, Sender: sender}}
+		set.tenants = append(set.tenants, set.fallback)
+	}
+
+	for i, t := range tenants {
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Name == "" {
+			return nil, fmt.Errorf("tenant %d must have a name", i+1)
+		}
+		if set.get(t.Name) != nil || t.Name == DefaultTenant {
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		if t.Credential == nil && t.Sender == nil {
+			return nil, fmt.Errorf("tenant %q must have a credential", t.Name)
+		}
+
+		t.Domains = normalizePatterns(t.Domains)
+		for _, pattern := range t.Domains {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid domain %q for tenant %q: %w", pattern, t.Name, err)
+			}
+		}
+
+		users := make([]string, 0, len(t.Users))
+		for _, user := range t.Users {
+			if user = strings.TrimSpace(user); user != "" {
+				users = append(users, user)
+			}
+		}
+		t.Users = users
+
+		set.tenants = append(set.tenants, &tenant{Tenant: t})
+	}
+
+	if len(set.tenants) == 0 {
+		return nil, fmt.Errorf("no graph credential was provided")
+	}
+
+	return set, nil
+}
+
+// get returns the tenant called name, where "" is the default tenant, or nil
+// if there is no such tenant
+func (s *tenantSet) get(name string) *tenant {
+	if name == "" {
+		name = DefaultTenant
+	}
+
+	for _, t := range s.tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// route returns the tenant for a message from sender, sent by the
+// authenticated user (which may be ""). Tenants listing the user are preferred
+// over those matching the domain of sender, otherwise the default tenant is
+// returned, which may be nil.
+func (s *tenantSet) route(user, sender string) *tenant {
+	if user != "" {
+		for _, t := range s.tenants {
+			if slices.Contains(t.Users, user) {
+				return t
+			}
+		}
+	}
+
+	_, domain, _ := strings.Cut(sender, "@")
+	for _, t := range s.tenants {
+		if matchPatterns(t.Domains, domain) {
+			return t
+		}
+	}
+
+	return s.fallback
+}
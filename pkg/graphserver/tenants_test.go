@@ -0,0 +1,69 @@
+package graphserver
+
+import (
+	"testing"
+
+	"github.com/tombull/office365-smtp-proxy/pkg/graphclient"
+)
+
+func TestTenantRoute(t *testing.T) {
+	cred := graphclient.WithClientSecret("tenant", "client", "secret")
+
+	tenants, err := newTenantSet(cred, nil, []Tenant{
+		{Name: "subsidiary-a", Credential: cred, Domains: []string{"A.example.com", "*.a.example.com"}},
+		{Name: "subsidiary-b", Credential: cred, Domains: []string{"b.example.com"}, Users: []string{"printer-b"}},
+	})
+	if err != nil {
+		t.Fatalf("newTenantSet() error = %v", err)
+	}
+
+	tests := []struct {
+		user   string
+		sender string
+		want   string
+	}{
+		{"", "user@a.example.com", "subsidiary-a"},
+		{"", "user@mail.a.example.com", "subsidiary-a"},
+		{"", "user@b.example.com", "subsidiary-b"},
+		{"printer-b", "scanner@a.example.com", "subsidiary-b"},
+		{"", "user@example.com", DefaultTenant},
+	}
+
+	for _, tt := range tests {
+		if got := tenants.route(tt.user, tt.sender); got == nil || got.Name != tt.want {
+			t.Errorf("route(%q, %q) = %v, want %q", tt.user, tt.sender, got, tt.want)
+		}
+	}
+
+	if got := tenants.get(""); got == nil || got.Name != DefaultTenant {
+		t.Errorf("get(\"\") = %v, want default tenant", got)
+	}
+
+	// without a default credential unmatched senders have no tenant
+	tenants, err = newTenantSet(nil, nil, []Tenant{{Name: "subsidiary-a", Credential: cred, Domains: []string{"a.example.com"}}})
+	if err != nil {
+		t.Fatalf("newTenantSet() error = %v", err)
+	}
+	if got := tenants.route("", "user@example.com"); got != nil {
+		t.Errorf("route() without default = %v, want nil", got)
+	}
+}
+
+func TestNewTenantSetErrors(t *testing.T) {
+	cred := graphclient.WithClientSecret("tenant", "client", "secret")
+
+	tests := map[string][]Tenant{
+		"no credentials":  nil,
+		"missing name":    {{Credential: cred}},
+		"duplicate name":  {{Name: "a", Credential: cred}, {Name: "a", Credential: cred}},
+		"default name":    {{Name: DefaultTenant, Credential: cred}},
+		"no credential":   {{Name: "a"}},
+		"invalid pattern": {{Name: "a", Credential: cred, Domains: []string{"["}}},
+	}
+
+	for name, tenants := range tests {
+		if _, err := newTenantSet(nil, nil, tenants); err == nil {
+			t.Errorf("%s: newTenantSet() error = nil, want error", name)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package graphserver
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errDataTimeout = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Timeout waiting for message data",
+}
+
+// deadlineReader extends the read deadline of conn before each read, so that
+// slow clients may send large messages while stalled clients time out
+type deadlineReader struct {
+	r       io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if err := d.conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+
+	return d.r.Read(p)
+}
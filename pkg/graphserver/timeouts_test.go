@@ -0,0 +1,31 @@
+package graphserver
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDataReadTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	s := &Session{
+		from:        "user@example.com",
+		recipients:  []string{"rcpt@example.com"},
+		conn:        server,
+		readTimeout: 20 * time.Millisecond,
+		sendErrors:  prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"}),
+	}
+
+	// the client sends part of a message and then stalls
+	go client.Write([]byte("Subject: test\r\n"))
+
+	if err := s.Data(server); !errors.Is(err, errDataTimeout) {
+		t.Errorf("Data() from stalled client error = %v, want %v", err, errDataTimeout)
+	}
+}
@@ -0,0 +1,99 @@
+// Package maildir delivers MIME messages to a local Maildir, so the proxy can
+// be tested without sending mail.
+package maildir
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Maildir struct {
+	dir      string
+	hostname string
+}
+
+// New opens (creating if required) the Maildir at dir
+func New(dir string) (*Maildir, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("could not create maildir: %w", err)
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	// slashes and colons have special meaning in maildir file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return &Maildir{dir: dir, hostname: hostname}, nil
+}
+
+// SendMime writes mime to the new directory of the Maildir, with the envelope
+// recorded in Return-Path and X-Original-To headers and the user in an
+// X-Graph-User header
+func (m *Maildir) SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	name, err := m.filename()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Return-Path: <%s>\r\n", from)
+	fmt.Fprintf(&b, "X-Original-To: %s\r\n", strings.Join(recipients, ", "))
+	if user != "" {
+		fmt.Fprintf(&b, "X-Graph-User: %s\r\n", user)
+	}
+
+	// write to tmp then move into new, so readers never see partial messages
+	tmp := filepath.Join(m.dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not create message: %w", err)
+	}
+
+	_, err = f.WriteString(b.String())
+	if err == nil {
+		_, err = f.Write(mime)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write message: %w", err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(m.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not deliver message: %w", err)
+	}
+
+	return nil
+}
+
+// filename returns a unique name for a message
+func (m *Maildir) filename() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), hex.EncodeToString(b), m.hostname), nil
+}
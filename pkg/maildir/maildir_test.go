@@ -0,0 +1,45 @@
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendMime(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	mime := []byte("From: sender@example.com\r\nSubject: test\r\n\r\nbody\r\n")
+	for i := 0; i < 2; i++ {
+		if err := m.SendMime(context.Background(), "relay@example.com", "sender@example.com", []string{"a@example.com", "b@example.com"}, mime); err != nil {
+			t.Fatalf("SendMime() error = %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("os.ReadDir() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("new contains %d messages, want 2", len(entries))
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+
+	want := "Return-Path: <sender@example.com>\r\nX-Original-To: a@example.com, b@example.com\r\nX-Graph-User: relay@example.com\r\n" + string(mime)
+	if string(b) != want {
+		t.Errorf("message = %q, want %q", b, want)
+	}
+
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp contains %d files, want 0", len(tmp))
+	}
+}
@@ -0,0 +1,52 @@
+package relayclient
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+type ClientOption func(*Client)
+
+// WithAuth authenticates to the relay with PLAIN, which requires TLS
+func WithAuth(username, password string) ClientOption {
+	return func(c *Client) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithTLS sets how the connection is encrypted, either TLSStartTLS (the
+// default), TLSImplicit or TLSNone
+func WithTLS(mode string) ClientOption {
+	return func(c *Client) {
+		if mode = strings.ToLower(strings.TrimSpace(mode)); mode != "" {
+			c.tlsMode = mode
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to the relay
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithLocalName sets the hostname sent in EHLO
+func WithLocalName(name string) ClientOption {
+	return func(c *Client) {
+		if name != "" {
+			c.localName = name
+		}
+	}
+}
+
+// WithTimeout bounds each delivery when the context has no deadline
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if timeout > 0 {
+			c.timeout = timeout
+		}
+	}
+}
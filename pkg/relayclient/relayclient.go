@@ -0,0 +1,202 @@
+// Package relayclient delivers MIME messages to an upstream SMTP relay, such
+// as an on-premises mail server or the MX endpoint of a tenant.
+package relayclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// TLS modes
+const (
+	// TLSStartTLS requires the relay to offer STARTTLS
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects using TLS, as for SMTPS on port 465
+	TLSImplicit = "tls"
+	// TLSNone sends in the clear
+	TLSNone = "none"
+)
+
+type Client struct {
+	addr      string
+	host      string
+	tlsMode   string
+	tlsConfig *tls.Config
+	username  string
+	password  string
+	localName string
+	timeout   time.Duration
+}
+
+// ReplyError is an error reply from the relay
+type ReplyError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("relay replied %d %s", e.Code, e.Msg)
+}
+
+// Permanent reports whether the relay rejected the message permanently
+func (e *ReplyError) Permanent() bool {
+	return e.Code >= 500
+}
+
+// New creates a client for the relay at addr, which must include the port
+func New(addr string, opts ...ClientOption) (*Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %q: %w", addr, err)
+	}
+
+	c := &Client{
+		addr:      addr,
+		host:      host,
+		tlsMode:   TLSStartTLS,
+		localName: "localhost",
+		timeout:   5 * time.Minute,
+	}
+
+	// apply options
+	for _, o := range opts {
+		o(c)
+	}
+
+	switch c.tlsMode {
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return nil, fmt.Errorf("invalid relay TLS mode %q", c.tlsMode)
+	}
+
+	if c.username != "" && c.tlsMode == TLSNone {
+		return nil, fmt.Errorf("relay authentication requires TLS")
+	}
+
+	if c.tlsConfig == nil {
+		c.tlsConfig = &tls.Config{}
+	}
+	if c.tlsConfig.ServerName == "" {
+		c.tlsConfig = c.tlsConfig.Clone()
+		c.tlsConfig.ServerName = host
+	}
+
+	return c, nil
+}
+
+// Host returns the host name of the relay
+func (c *Client) Host() string {
+	return c.host
+}
+
+// SendMime delivers mime from the envelope sender to recipients. The user is
+// not used, as the relay decides how to deliver the message.
+func (c *Client) SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("could not connect to relay: %w", err)
+	}
+	defer conn.Close()
+
+	// bound the whole transaction by the context deadline or timeout
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// abort the transaction if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := c.send(conn, from, recipients, mime); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return replyError(err)
+	}
+
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if c.tlsMode == TLSImplicit {
+		return (&tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}).DialContext(ctx, "tcp", c.addr)
+	}
+
+	return dialer.DialContext(ctx, "tcp", c.addr)
+}
+
+func (c *Client) send(conn net.Conn, from string, recipients []string, mime []byte) error {
+	client, err := smtp.NewClient(conn, c.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Hello(c.localName); err != nil {
+		return err
+	}
+
+	if c.tlsMode == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("relay does not support STARTTLS")
+		}
+		if err := client.StartTLS(c.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if c.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.username, c.password, c.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(mime)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// replyError converts SMTP replies to a ReplyError
+func replyError(err error) error {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return &ReplyError{Code: tpErr.Code, Msg: tpErr.Msg}
+	}
+
+	return err
+}
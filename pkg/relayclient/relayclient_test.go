@@ -0,0 +1,97 @@
+package relayclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+type testBackend struct {
+	from       string
+	recipients []string
+	data       []byte
+}
+
+func (b *testBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &testSession{b}, nil
+}
+
+type testSession struct {
+	b *testBackend
+}
+
+func (s *testSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.b.from = from
+	return nil
+}
+
+func (s *testSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if to == "unknown@example.com" {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	s.b.recipients = append(s.b.recipients, to)
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	s.b.data = data
+	return err
+}
+
+func (s *testSession) Reset()        {}
+func (s *testSession) Logout() error { return nil }
+
+func TestSendMime(t *testing.T) {
+	be := &testBackend{}
+	srv := smtp.NewServer(be)
+	srv.Domain = "relay.test"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := New(l.Addr().String(), WithTLS(TLSNone), WithLocalName("proxy.test"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	mime := []byte("From: sender@example.com\r\nSubject: test\r\n\r\nbody\r\n")
+	if err := c.SendMime(context.Background(), "", "sender@example.com", []string{"rcpt@example.com"}, mime); err != nil {
+		t.Fatalf("SendMime() error = %v", err)
+	}
+
+	if be.from != "sender@example.com" || len(be.recipients) != 1 || be.recipients[0] != "rcpt@example.com" {
+		t.Errorf("envelope = %q %v, want sender@example.com [rcpt@example.com]", be.from, be.recipients)
+	}
+	if string(be.data) != string(mime) {
+		t.Errorf("data = %q, want %q", be.data, mime)
+	}
+
+	err = c.SendMime(context.Background(), "", "sender@example.com", []string{"unknown@example.com"}, mime)
+	var reply *ReplyError
+	if !errors.As(err, &reply) || reply.Code != 550 || !reply.Permanent() {
+		t.Errorf("SendMime() to unknown recipient error = %v, want permanent 550 reply", err)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New("relay.example.com"); err == nil {
+		t.Errorf("New() without port error = nil, want error")
+	}
+
+	if _, err := New("relay.example.com:25", WithTLS("ssl")); err == nil {
+		t.Errorf("New() with invalid TLS mode error = nil, want error")
+	}
+
+	if _, err := New("relay.example.com:25", WithTLS(TLSNone), WithAuth("user", "pass")); err == nil {
+		t.Errorf("New() with auth without TLS error = nil, want error")
+	}
+}
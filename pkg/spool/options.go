@@ -0,0 +1,50 @@
+package spool
+
+import "time"
+
+type Option func(*Spool)
+
+// WithExpiry sets how long delivery is retried before a message is given up on
+func WithExpiry(expiry time.Duration) Option {
+	return func(s *Spool) {
+		if expiry > 0 {
+			s.expiry = expiry
+		}
+	}
+}
+
+// WithBackoff sets the initial and maximum delay between delivery attempts
+func WithBackoff(initial, max time.Duration) Option {
+	return func(s *Spool) {
+		if initial > 0 {
+			s.backoff = initial
+		}
+		if max > 0 {
+			s.backoffMax = max
+		}
+	}
+}
+
+// WithInterval sets how often the spool is scanned for messages due a retry
+func WithInterval(interval time.Duration) Option {
+	return func(s *Spool) {
+		if interval > 0 {
+			s.interval = interval
+		}
+	}
+}
+
+// WithWorkers sets how many messages are delivered at once
+func WithWorkers(workers int) Option {
+	return func(s *Spool) {
+		if workers > 0 {
+			s.workers = workers
+		}
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(s *Spool) {
+		s.logger = logger
+	}
+}
@@ -0,0 +1,464 @@
+package spool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metaExt = ".json"
+	mimeExt = ".eml"
+	tmpExt  = ".tmp"
+)
+
+// Logger is a basic levelled logger
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+}
+
+// Message is a spooled message awaiting delivery
+type Message struct {
+	ID          string    `json:"id"`
+	GraphUser   string    `json:"graph_user"`
+	Tenant      string    `json:"tenant,omitempty"`
+	From        string    `json:"from"`
+	Recipients  []string  `json:"recipients"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Route is set by the DeliverFunc to the route that delivered the message
+	Route string `json:"-"`
+
+	// MIME is stored alongside the metadata rather than within it
+	MIME []byte `json:"-"`
+}
+
+// DeliverFunc attempts delivery of a spooled message
+type DeliverFunc func(ctx context.Context, msg *Message) error
+
+// Spool is a durable on-disk message queue
+type Spool struct {
+	dir        string
+	expiry     time.Duration
+	backoff    time.Duration
+	backoffMax time.Duration
+	interval   time.Duration
+	workers    int
+	logger     Logger
+
+	// mu guards the spool files and inflight, but is not held while
+	// messages are delivered
+	mu       sync.Mutex
+	inflight map[string]bool
+	wg       sync.WaitGroup
+	wake     chan struct{}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks a delivery error as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether err was marked as permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// New opens (creating if required) a spool directory
+func New(dir string, opts ...Option) (*Spool, error) {
+	s := &Spool{
+		dir:        dir,
+		expiry:     24 * time.Hour,
+		backoff:    time.Minute,
+		backoffMax: time.Hour,
+		interval:   30 * time.Second,
+		workers:    4,
+		inflight:   make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+	}
+
+	// apply options
+	for _, o := range opts {
+		o(s)
+	}
+
+	if s.dir == "" {
+		return nil, fmt.Errorf("spool directory must not be blank")
+	}
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+
+	// remove any partial writes from a previous run
+	tmp, err := filepath.Glob(filepath.Join(s.dir, "*"+tmpExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range tmp {
+		os.Remove(name)
+	}
+
+	return s, nil
+}
+
+// Enqueue durably writes a message to the spool. Once Enqueue returns without
+// error the message will survive a process restart.
+func (s *Spool) Enqueue(msg *Message) error {
+	if msg.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		msg.ID = id
+	}
+
+	now := time.Now()
+	if msg.Created.IsZero() {
+		msg.Created = now
+	}
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = now
+	}
+
+	// MIME first, as the metadata file marks the message as complete
+	if err := s.writeFile(msg.ID+mimeExt, msg.MIME); err != nil {
+		return fmt.Errorf("could not write spooled message: %w", err)
+	}
+
+	if err := s.writeMeta(msg); err != nil {
+		os.Remove(filepath.Join(s.dir, msg.ID+mimeExt))
+		return fmt.Errorf("could not write spooled message metadata: %w", err)
+	}
+
+	// trigger immediate delivery attempt
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Pending returns the number of messages in the spool
+func (s *Spool) Pending() (int, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+metaExt))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(names), nil
+}
+
+// Run delivers spooled messages until ctx is cancelled, waiting for deliveries
+// in progress before returning. Deliveries in progress are not cancelled with
+// ctx, so deliver decides how long they may continue during shutdown.
+//
+// Messages are delivered concurrently by up to the number of workers set with
+// WithWorkers. Failed deliveries are retried with exponential backoff until
+// they succeed, fail permanently or expire. The onFailure function, if not
+// nil, is called for every message that is given up on after it is removed
+// from the spool.
+func (s *Spool) Run(ctx context.Context, deliver DeliverFunc, onFailure func(msg *Message, err error)) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	sem := make(chan struct{}, s.workers)
+	defer s.wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		case <-s.wake:
+		}
+
+		s.process(ctx, sem, deliver, onFailure)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(s.interval)
+	}
+}
+
+// process starts delivery of the messages that are due, waiting for a free
+// worker for each
+func (s *Spool) process(ctx context.Context, sem chan struct{}, deliver DeliverFunc, onFailure func(msg *Message, err error)) {
+	s.mu.Lock()
+	msgs, err := s.load()
+	if err != nil {
+		s.mu.Unlock()
+		s.log().Error("could not read spool", "error", err, "dir", s.dir)
+		return
+	}
+
+	now := time.Now()
+	due := make([]*Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if s.inflight[msg.ID] || msg.NextAttempt.After(now) {
+			continue
+		}
+		s.inflight[msg.ID] = true
+		due = append(due, msg)
+	}
+	s.mu.Unlock()
+
+	for i, msg := range due {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			s.mu.Lock()
+			for _, msg := range due[i:] {
+				delete(s.inflight, msg.ID)
+			}
+			s.mu.Unlock()
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-sem }()
+
+			s.deliver(ctx, msg, deliver, onFailure)
+		}()
+	}
+}
+
+// deliver attempts delivery of msg and updates the spool with the result
+func (s *Spool) deliver(ctx context.Context, msg *Message, deliver DeliverFunc, onFailure func(msg *Message, err error)) {
+	// the MIME is read without holding the lock, as only this worker uses it
+	mime, err := os.ReadFile(filepath.Join(s.dir, msg.ID+mimeExt))
+	if err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.log().Error("removing incomplete spool entry", "error", err, "id", msg.ID)
+		s.remove(msg.ID)
+		delete(s.inflight, msg.ID)
+		return
+	}
+	msg.MIME = mime
+
+	err = deliver(context.WithoutCancel(ctx), msg)
+
+	// failure handlers may be slow, such as sending a bounce, so are called
+	// without holding the lock
+	if s.update(ctx, msg, err) && onFailure != nil {
+		onFailure(msg, err)
+	}
+}
+
+// update records the result of a delivery attempt, returning true if the
+// message was given up on
+func (s *Spool) update(ctx context.Context, msg *Message, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer delete(s.inflight, msg.ID)
+
+	if err == nil {
+		s.log().Info("spooled message delivered", "id", msg.ID, "from", msg.From, "graph_user", msg.GraphUser, "to", strings.Join(msg.Recipients, ","), "attempts", msg.Attempts+1, "route", msg.Route)
+		s.remove(msg.ID)
+		return false
+	}
+
+	// shutting down is not a failed attempt
+	if ctx.Err() != nil {
+		return false
+	}
+
+	msg.Attempts++
+	msg.LastError = err.Error()
+
+	if IsPermanent(err) || time.Since(msg.Created) > s.expiry {
+		s.log().Error("spooled message failed", "id", msg.ID, "error", err, "from", msg.From, "graph_user", msg.GraphUser, "to", strings.Join(msg.Recipients, ","), "attempts", msg.Attempts, "permanent", IsPermanent(err))
+		s.remove(msg.ID)
+		return true
+	}
+
+	msg.NextAttempt = time.Now().Add(s.delay(msg.Attempts))
+	s.log().Warn("spooled message deferred", "id", msg.ID, "error", err, "from", msg.From, "graph_user", msg.GraphUser, "attempts", msg.Attempts, "next_attempt", msg.NextAttempt)
+	if err := s.writeMeta(msg); err != nil {
+		s.log().Error("could not update spooled message", "id", msg.ID, "error", err)
+	}
+
+	return false
+}
+
+// load reads the metadata of all complete messages from the spool, oldest
+// first. The MIME is not read, as it is only needed for messages that are
+// delivered and may be large.
+func (s *Spool) load() ([]*Message, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+metaExt))
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*Message, 0, len(names))
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := new(Message)
+		if err := json.Unmarshal(b, msg); err != nil {
+			s.log().Error("removing corrupt spool entry", "error", err, "file", name)
+			s.remove(strings.TrimSuffix(filepath.Base(name), metaExt))
+			continue
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created.Before(msgs[j].Created)
+	})
+
+	return msgs, nil
+}
+
+func (s *Spool) delay(attempts int) time.Duration {
+	d := s.backoff
+	for i := 1; i < attempts && d < s.backoffMax; i++ {
+		d *= 2
+	}
+
+	return min(d, s.backoffMax)
+}
+
+func (s *Spool) writeMeta(msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(msg.ID+metaExt, b)
+}
+
+// writeFile atomically replaces name in the spool directory, syncing both the
+// file and the directory so the write survives a crash.
+func (s *Spool) writeFile(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmp := path + tmpExt
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return s.syncDir()
+}
+
+// Check reports whether messages can be written to the spool by writing and
+// removing a probe file
+func (s *Spool) Check() error {
+	f, err := os.CreateTemp(s.dir, "probe-*"+tmpExt)
+	if err != nil {
+		return fmt.Errorf("spool is not writable: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("spool is not writable: %w", err)
+	}
+
+	return f.Close()
+}
+
+func (s *Spool) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (s *Spool) remove(id string) {
+	os.Remove(filepath.Join(s.dir, id+metaExt))
+	os.Remove(filepath.Join(s.dir, id+mimeExt))
+	s.syncDir()
+}
+
+func (s *Spool) log() Logger {
+	if s.logger == nil {
+		return discardLogger{}
+	}
+
+	return s.logger
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate spool id: %w", err)
+	}
+
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Error(msg string, args ...any) {}
+func (discardLogger) Info(msg string, args ...any)  {}
+func (discardLogger) Warn(msg string, args ...any)  {}
@@ -0,0 +1,210 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolRetriesUntilDelivered(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir, WithBackoff(time.Millisecond, time.Millisecond), WithInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := s.Enqueue(&Message{GraphUser: "test1@example.com", From: "test1@example.com", Recipients: []string{"test2@example.com"}, MIME: []byte("Subject: test\r\n\r\nbody")}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	// reopening the spool must resume the pending message
+	s, err = New(dir, WithBackoff(time.Millisecond, time.Millisecond), WithInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	attempts := 0
+	deliver := func(ctx context.Context, msg *Message) error {
+		attempts++
+		if string(msg.MIME) != "Subject: test\r\n\r\nbody" {
+			t.Errorf("MIME = %q, want original message", msg.MIME)
+		}
+		if attempts < 3 {
+			return errors.New("temporary failure")
+		}
+		cancel()
+		return nil
+	}
+
+	if err := s.Run(ctx, deliver, nil); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("deliver called %d times, want 3", attempts)
+	}
+
+	if pending, _ := s.Pending(); pending != 0 {
+		t.Fatalf("Pending() = %d, want 0", pending)
+	}
+}
+
+func TestSpoolGivesUpOnPermanentError(t *testing.T) {
+	s, err := New(t.TempDir(), WithInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := s.Enqueue(&Message{GraphUser: "test1@example.com", From: "test1@example.com", Recipients: []string{"test2@example.com"}, MIME: []byte("body")}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var failed *Message
+	deliver := func(ctx context.Context, msg *Message) error {
+		return Permanent(errors.New("mailbox not found"))
+	}
+	onFailure := func(msg *Message, err error) {
+		failed = msg
+		cancel()
+	}
+
+	if err := s.Run(ctx, deliver, onFailure); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if failed == nil || failed.Attempts != 1 || failed.LastError != "mailbox not found" {
+		t.Fatalf("onFailure message = %+v, want single failed attempt", failed)
+	}
+
+	if pending, _ := s.Pending(); pending != 0 {
+		t.Fatalf("Pending() = %d, want 0", pending)
+	}
+}
+
+func TestSpoolSlowDeliveryDoesNotBlock(t *testing.T) {
+	s, err := New(t.TempDir(), WithInterval(time.Millisecond), WithWorkers(2))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := s.Enqueue(&Message{GraphUser: "slow@example.com", From: "slow@example.com", Recipients: []string{"test2@example.com"}, MIME: []byte("body")}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fast := make(chan struct{})
+	deliver := func(_ context.Context, msg *Message) error {
+		if msg.GraphUser != "slow@example.com" {
+			close(fast)
+			return nil
+		}
+
+		// the slow send is still in progress while the other is enqueued
+		// and delivered
+		if err := s.Enqueue(&Message{GraphUser: "fast@example.com", From: "fast@example.com", Recipients: []string{"test2@example.com"}, MIME: []byte("body")}); err != nil {
+			t.Errorf("Enqueue() error = %v", err)
+		}
+		select {
+		case <-fast:
+		case <-ctx.Done():
+			t.Errorf("message was not delivered while another was in progress")
+		}
+		cancel()
+		return nil
+	}
+
+	if err := s.Run(ctx, deliver, nil); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if pending, _ := s.Pending(); pending != 0 {
+		t.Fatalf("Pending() = %d, want 0", pending)
+	}
+}
+
+func TestSpoolCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := s.Check(); err != nil {
+		t.Errorf("Check() error = %v, want nil", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Check() left %d files in the spool", len(entries))
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if err := s.Check(); err == nil {
+		t.Errorf("Check() of missing spool error = nil, want error")
+	}
+}
+
+func TestSpoolReadsMIMEOnlyForDueMessages(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir, WithInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// a message that is not yet due has its MIME removed, which would be
+	// found if it were read
+	later := &Message{GraphUser: "later@example.com", From: "later@example.com", Recipients: []string{"test2@example.com"}, NextAttempt: time.Now().Add(time.Hour), MIME: []byte("body")}
+	if err := s.Enqueue(later); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, later.ID+mimeExt)); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	if err := s.Enqueue(&Message{GraphUser: "due@example.com", From: "due@example.com", Recipients: []string{"test2@example.com"}, MIME: []byte("body")}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	msgs, err := s.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	for _, msg := range msgs {
+		if msg.MIME != nil {
+			t.Errorf("load() read the MIME of %s", msg.GraphUser)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	deliver := func(_ context.Context, msg *Message) error {
+		if msg.GraphUser != "due@example.com" || string(msg.MIME) != "body" {
+			t.Errorf("delivered %s with MIME %q, want due@example.com with body", msg.GraphUser, msg.MIME)
+		}
+		cancel()
+		return nil
+	}
+
+	if err := s.Run(ctx, deliver, nil); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if pending, _ := s.Pending(); pending != 1 {
+		t.Fatalf("Pending() = %d, want the message that is not due", pending)
+	}
+}
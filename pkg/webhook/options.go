@@ -0,0 +1,21 @@
+package webhook
+
+import "net/http"
+
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		if client != nil {
+			c.httpClient = client
+		}
+	}
+}
+
+// WithHeader adds a header to every request, such as an Authorization token
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		c.headers.Add(key, value)
+	}
+}
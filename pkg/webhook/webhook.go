@@ -0,0 +1,111 @@
+// Package webhook delivers MIME messages by POSTing them with their envelope
+// as JSON to an HTTP endpoint.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Payload is the JSON body sent for each message. MIME is encoded as base64.
+type Payload struct {
+	User       string   `json:"user,omitempty"`
+	From       string   `json:"from"`
+	Recipients []string `json:"recipients"`
+	MIME       []byte   `json:"mime"`
+}
+
+type Client struct {
+	url        string
+	host       string
+	httpClient *http.Client
+	headers    http.Header
+}
+
+// StatusError is returned when the endpoint responds with a non-2xx status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Permanent reports whether the endpoint rejected the message, which is the
+// case for client errors other than timeouts and throttling
+func (e *StatusError) Permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+// New creates a client that POSTs messages to endpoint
+func New(endpoint string, opts ...ClientOption) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", endpoint)
+	}
+
+	c := &Client{
+		url:        endpoint,
+		host:       u.Hostname(),
+		httpClient: &http.Client{Timeout: 2 * time.Minute},
+		headers:    make(http.Header),
+	}
+
+	// apply options
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c, nil
+}
+
+// Host returns the host name of the endpoint
+func (c *Client) Host() string {
+	return c.host
+}
+
+// SendMime POSTs mime and its envelope to the endpoint
+func (c *Client) SendMime(ctx context.Context, user, from string, recipients []string, mime []byte) error {
+	body, err := json.Marshal(Payload{
+		User:       user,
+		From:       from,
+		Recipients: recipients,
+		MIME:       mime,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	for key, values := range c.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return &StatusError{StatusCode: res.StatusCode, Body: string(bytes.TrimSpace(msg))}
+	}
+
+	// drain the body so the connection may be reused
+	io.Copy(io.Discard, res.Body)
+
+	return nil
+}
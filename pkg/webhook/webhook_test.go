@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendMime(t *testing.T) {
+	var got Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if got.From == "rejected@example.com" {
+			http.Error(w, "sender rejected", http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, WithHeader("Authorization", "Bearer token"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	mime := []byte("Subject: test\r\n\r\nbody\r\n")
+	if err := c.SendMime(context.Background(), "relay@example.com", "sender@example.com", []string{"rcpt@example.com"}, mime); err != nil {
+		t.Fatalf("SendMime() error = %v", err)
+	}
+
+	if got.User != "relay@example.com" || got.From != "sender@example.com" || len(got.Recipients) != 1 || string(got.MIME) != string(mime) {
+		t.Errorf("payload = %+v, want envelope and MIME", got)
+	}
+
+	err = c.SendMime(context.Background(), "", "rejected@example.com", []string{"rcpt@example.com"}, mime)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnprocessableEntity || !statusErr.Permanent() {
+		t.Errorf("SendMime() error = %v, want permanent 422", err)
+	}
+}
+
+func TestStatusErrorPermanent(t *testing.T) {
+	tests := map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusTooManyRequests:     false,
+		http.StatusRequestTimeout:      false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	}
+
+	for code, want := range tests {
+		if got := (&StatusError{StatusCode: code}).Permanent(); got != want {
+			t.Errorf("StatusError{%d}.Permanent() = %v, want %v", code, got, want)
+		}
+	}
+
+	if _, err := New("ftp://example.com/hook"); err == nil {
+		t.Errorf("New() with ftp URL error = nil, want error")
+	}
+}